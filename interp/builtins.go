@@ -0,0 +1,545 @@
+package interp
+
+import (
+	"fmt"
+	"reflect"
+
+	"neugram.io/ng/eval/gowrap"
+	"neugram.io/ng/eval/gowrap/genwrap"
+	"neugram.io/ng/gotool"
+)
+
+// newBuiltins returns the root environment holding the builtin functions.
+func newBuiltins() *environment {
+	return &environment{
+		modules: &modules{loaded: map[string]*namespace{}},
+		values: map[string]*expression{
+			// TODO(robbiev): lex question marks
+			"panic": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if len(args) > 0 && args[0].atom != nil && args[0].atom.str != nil {
+						return nil, newError(RuntimeError, "panic: %s", exprToString(args[0]))
+					}
+					return nil, newError(RuntimeError, "panic: unknown reason")
+				},
+			},
+			"str": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					var result string
+					if len(args) > 0 {
+						result = exprToString(args[0])
+					}
+					return &expression{
+						atom: &atom{
+							str: &result,
+						},
+					}, nil
+				},
+			},
+			"empty": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("empty", args, 1, 1); err != nil {
+						return nil, err
+					}
+					n, err := countArg("empty", args[0])
+					if err != nil {
+						return nil, err
+					}
+					result := n == 0
+					return &expression{
+						atom: &atom{
+							boolean: &result,
+						},
+					}, nil
+				},
+			},
+			"=": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					eq := true
+					for i := 1; i < len(args); i++ {
+						eq = eq && equal(args[i-1], args[i])
+					}
+					return &expression{
+						atom: &atom{boolean: &eq},
+					}, nil
+				},
+			},
+			"+": &expression{
+				gofunc: arithFunc("+", 0),
+			},
+			"-": &expression{
+				gofunc: arithFunc("-", 0),
+			},
+			"*": &expression{
+				gofunc: arithFunc("*", 1),
+			},
+			"/": &expression{
+				gofunc: arithFunc("/", 1),
+			},
+			"mod": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("mod", args, 2, 2); err != nil {
+						return nil, err
+					}
+					if err := numberArgs("mod", args); err != nil {
+						return nil, err
+					}
+					result, err := arith("mod", args[0].atom, args[1].atom)
+					if err != nil {
+						return nil, err
+					}
+					return &expression{
+						atom: result,
+					}, nil
+				},
+			},
+			"first": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("first", args, 1, 1); err != nil {
+						return nil, err
+					}
+					if !isSeq(args[0]) {
+						return nil, newError(TypeError, "first: not a list or vector: %s", exprToString(args[0]))
+					}
+					return first(args[0]), nil
+				},
+			},
+			"rest": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("rest", args, 1, 1); err != nil {
+						return nil, err
+					}
+					if !isSeq(args[0]) {
+						return nil, newError(TypeError, "rest: not a list or vector: %s", exprToString(args[0]))
+					}
+					return rest(args[0]), nil
+				},
+			},
+			"apply": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("apply", args, 2, 2); err != nil {
+						return nil, err
+					}
+					if _, ok := keywordName(args[0]); !ok && !isFunc(args[0]) {
+						return nil, newError(TypeError, "apply: not a function: %s", exprToString(args[0]))
+					}
+					elems, err := seqArg("apply", args[1])
+					if err != nil {
+						return nil, err
+					}
+					return apply(env, args[0], elems)
+				},
+			},
+			"vector": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					return &expression{
+						vector: newVector(args),
+					}, nil
+				},
+			},
+			"hash-map": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if len(args)%2 != 0 {
+						return nil, newError(ArityError, "hash-map: odd number of arguments: %d", len(args))
+					}
+					m := &hashMap{}
+					for i := 0; i < len(args); i += 2 {
+						m = m.assoc(args[i], args[i+1])
+					}
+					return &expression{hashMap: m}, nil
+				},
+			},
+			"hash-set": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					set := &hashSet{}
+					for _, a := range args {
+						set = set.conj(a)
+					}
+					return &expression{set: set}, nil
+				},
+			},
+			"get": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("get", args, 2, 3); err != nil {
+						return nil, err
+					}
+					var notFound *expression
+					if len(args) == 3 {
+						notFound = args[2]
+					}
+					coll, key := args[0], args[1]
+					switch {
+					case coll == nil:
+						return notFound, nil
+					case coll.hashMap != nil:
+						if v, ok := coll.hashMap.get(key); ok {
+							return v, nil
+						}
+					case coll.set != nil:
+						if coll.set.contains(key) {
+							return key, nil
+						}
+					case coll.vector != nil:
+						if i, ok := index(key); ok && i >= 0 && i < coll.vector.count {
+							return coll.vector.nth(i), nil
+						}
+					default:
+						return nil, newError(TypeError, "get: not a map, set or vector: %s", exprToString(coll))
+					}
+					return notFound, nil
+				},
+			},
+			"contains?": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("contains?", args, 2, 2); err != nil {
+						return nil, err
+					}
+					coll, key := args[0], args[1]
+					var result bool
+					switch {
+					case coll == nil:
+					case coll.hashMap != nil:
+						_, result = coll.hashMap.get(key)
+					case coll.set != nil:
+						result = coll.set.contains(key)
+					case coll.vector != nil:
+						i, ok := index(key)
+						result = ok && i >= 0 && i < coll.vector.count
+					default:
+						return nil, newError(TypeError, "contains?: not a map, set or vector: %s", exprToString(coll))
+					}
+					return &expression{
+						atom: &atom{boolean: &result},
+					}, nil
+				},
+			},
+			"new": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("new", args, 1, 1); err != nil {
+						return nil, err
+					}
+					t, ok := goType(args[0])
+					if !ok {
+						return nil, newError(TypeError, "new: not a Go type: %s", exprToString(args[0]))
+					}
+					return &expression{handle: &handle{reflect.New(t)}}, nil
+				},
+			},
+			"go": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("go", args, 1, -1); err != nil {
+						return nil, err
+					}
+					if !isFunc(args[0]) {
+						return nil, newError(TypeError, "go: not a function: %s", exprToString(args[0]))
+					}
+					return spawn(env, args[0], args[1:]), nil
+				},
+			},
+			"chan": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("chan", args, 0, 1); err != nil {
+						return nil, err
+					}
+					size := 0
+					if len(args) == 1 {
+						var err error
+						if size, err = intArg("chan", args[0]); err != nil {
+							return nil, err
+						}
+					}
+					return newChan(size), nil
+				},
+			},
+			"send": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("send", args, 2, 2); err != nil {
+						return nil, err
+					}
+					ch, err := chanArg("send", args[0])
+					if err != nil {
+						return nil, err
+					}
+					return nil, send(env, ch, args[1])
+				},
+			},
+			"recv": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("recv", args, 1, 1); err != nil {
+						return nil, err
+					}
+					ch, err := chanArg("recv", args[0])
+					if err != nil {
+						return nil, err
+					}
+					return recv(env, ch)
+				},
+			},
+			"close": &expression{
+				gofunc: func(env *environment, args []*expression) (result *expression, err error) {
+					// closing a closed channel panics
+					defer recoverError(&err)
+
+					if err := checkArity("close", args, 1, 1); err != nil {
+						return nil, err
+					}
+					ch, err := chanArg("close", args[0])
+					if err != nil {
+						return nil, err
+					}
+					ch.Close()
+					return nil, nil
+				},
+			},
+			"wait-group": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("wait-group", args, 0, 0); err != nil {
+						return nil, err
+					}
+					return newWaitGroup(), nil
+				},
+			},
+			"mutex": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("mutex", args, 0, 0); err != nil {
+						return nil, err
+					}
+					return newMutex(), nil
+				},
+			},
+			"count": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("count", args, 1, 1); err != nil {
+						return nil, err
+					}
+					n, err := countArg("count", args[0])
+					if err != nil {
+						return nil, err
+					}
+					return &expression{
+						atom: &atom{integer: &n},
+					}, nil
+				},
+			},
+			"nth": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("nth", args, 2, 2); err != nil {
+						return nil, err
+					}
+					if !isSeq(args[0]) {
+						return nil, newError(TypeError, "nth: not a list or vector: %s", exprToString(args[0]))
+					}
+					i, err := intArg("nth", args[1])
+					if err != nil {
+						return nil, err
+					}
+					if i < 0 || i >= seqLen(args[0]) {
+						return nil, newError(RuntimeError, "nth: index %d out of range for %s", i, exprToString(args[0]))
+					}
+					if args[0].vector != nil {
+						return args[0].vector.nth(i), nil
+					}
+					seq := args[0]
+					for ; i > 0 && seq.list != nil; i-- {
+						seq = seq.list.rest
+					}
+					if seq.list != nil {
+						return seq.list.first, nil
+					}
+					return seq.expressions[i], nil
+				},
+			},
+			"conj": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("conj", args, 1, -1); err != nil {
+						return nil, err
+					}
+					coll := args[0]
+					switch {
+					case coll == nil || (isSeq(coll) && coll.vector == nil):
+						// lists grow at the front
+						for _, a := range args[1:] {
+							coll = cons(a, coll)
+						}
+						return coll, nil
+					case coll.vector != nil:
+						v := coll.vector
+						for _, a := range args[1:] {
+							v = v.conj(a)
+						}
+						return &expression{vector: v}, nil
+					case coll.set != nil:
+						set := coll.set
+						for _, a := range args[1:] {
+							set = set.conj(a)
+						}
+						return &expression{set: set}, nil
+					case coll.hashMap != nil:
+						m := coll.hashMap
+						for _, a := range args[1:] {
+							entry, err := seqArg("conj", a)
+							if err != nil || len(entry) != 2 {
+								return nil, newError(TypeError, "conj: not a key and value pair: %s", exprToString(a))
+							}
+							m = m.assoc(entry[0], entry[1])
+						}
+						return &expression{hashMap: m}, nil
+					}
+					return nil, newError(TypeError, "conj: not a collection: %s", exprToString(coll))
+				},
+			},
+			"assoc": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("assoc", args, 3, -1); err != nil {
+						return nil, err
+					}
+					if len(args)%2 != 1 {
+						return nil, newError(ArityError, "assoc: missing value for key %s", exprToString(args[len(args)-1]))
+					}
+					if args[0] != nil && args[0].hashMap != nil {
+						m := args[0].hashMap
+						for i := 1; i+1 < len(args); i += 2 {
+							m = m.assoc(args[i], args[i+1])
+						}
+						return &expression{hashMap: m}, nil
+					}
+					if args[0] == nil || args[0].vector == nil {
+						return nil, newError(TypeError, "assoc: not a vector or map: %s", exprToString(args[0]))
+					}
+					v := args[0].vector
+					for i := 1; i+1 < len(args); i += 2 {
+						idx, err := intArg("assoc", args[i])
+						if err != nil {
+							return nil, err
+						}
+						if idx < 0 || idx > v.count {
+							return nil, newError(RuntimeError, "assoc: index %d out of range for %s", idx, exprToString(args[0]))
+						}
+						v = v.assoc(idx, args[i+1])
+					}
+					return &expression{
+						vector: v,
+					}, nil
+				},
+			},
+			"dissoc": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("dissoc", args, 1, -1); err != nil {
+						return nil, err
+					}
+					switch {
+					case args[0] != nil && args[0].hashMap != nil:
+						m := args[0].hashMap
+						for _, k := range args[1:] {
+							m = m.dissoc(k)
+						}
+						return &expression{hashMap: m}, nil
+					case args[0] != nil && args[0].set != nil:
+						set := args[0].set
+						for _, k := range args[1:] {
+							set = set.disj(k)
+						}
+						return &expression{set: set}, nil
+					}
+					return nil, newError(TypeError, "dissoc: not a map or set: %s", exprToString(args[0]))
+				},
+			},
+			"macro-expand": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("macro-expand", args, 1, 1); err != nil {
+						return nil, err
+					}
+					return expand(env, args[0])
+				},
+			},
+			"gensym": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("gensym", args, 0, 1); err != nil {
+						return nil, err
+					}
+					prefix := "G"
+					if len(args) == 1 {
+						var err error
+						if prefix, err = strArg("gensym", args[0]); err != nil {
+							return nil, err
+						}
+					}
+					return gensym(prefix), nil
+				},
+			},
+			"throw": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("throw", args, 1, 1); err != nil {
+						return nil, err
+					}
+					return nil, throw(args[0])
+				},
+			},
+			"error": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("error", args, 1, 1); err != nil {
+						return nil, err
+					}
+					msg, err := strArg("error", args[0])
+					if err != nil {
+						return nil, err
+					}
+					return &expression{
+						err: newError(RuntimeError, "%s", msg),
+					}, nil
+				},
+			},
+			"error-message": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("error-message", args, 1, 1); err != nil {
+						return nil, err
+					}
+					if args[0] == nil || args[0].err == nil {
+						return nil, newError(TypeError, "error-message: not an error: %s", exprToString(args[0]))
+					}
+					msg := args[0].err.Msg
+					return &expression{
+						atom: &atom{str: &msg},
+					}, nil
+				},
+			},
+			"import": &expression{
+				gofunc: func(env *environment, args []*expression) (*expression, error) {
+					if err := checkArity("import", args, 1, 1); err != nil {
+						return nil, err
+					}
+					path, err := strArg("import", args[0])
+					if err != nil {
+						return nil, err
+					}
+					src, err := genwrap.GenGo(path, "main", false)
+					if err != nil {
+						return nil, fmt.Errorf("plugin: wrapper gen failed for Go package %q: %v", path, err)
+					}
+					if _, err := gotool.M.Create(path, src); err != nil {
+						return nil, err
+					}
+
+					pkg, err := gotool.M.ImportGo(path)
+					if err != nil {
+						return nil, err
+					}
+					gowrap.Pkgs[pkg.Name()] = gowrap.Pkgs[path]
+					return nil, nil
+				},
+			},
+			">": &expression{
+				gofunc: compareFunc(">", func(cmp int) bool { return cmp > 0 }),
+			},
+			"<": &expression{
+				gofunc: compareFunc("<", func(cmp int) bool { return cmp < 0 }),
+			},
+			">=": &expression{
+				gofunc: compareFunc(">=", func(cmp int) bool { return cmp >= 0 }),
+			},
+			"<=": &expression{
+				gofunc: compareFunc("<=", func(cmp int) bool { return cmp <= 0 }),
+			},
+		},
+	}
+}
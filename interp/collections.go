@@ -0,0 +1,544 @@
+package interp
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// The collections are persistent: updates return a new version that shares
+// structure with the old one, which is left unchanged.
+
+// list is a cons cell, built by cons and conj. rest is the remaining list,
+// either another cell or a list read from source, never nil.
+type list struct {
+	first *expression
+	rest  *expression
+	count int
+}
+
+var emptyList = &expression{}
+
+// cons returns a list with x in front of seq, which may be nil. Consing onto
+// a list takes constant time.
+func cons(x, seq *expression) *expression {
+	switch {
+	case seq == nil:
+		seq = emptyList
+	case seq.vector != nil:
+		seq = &expression{expressions: seq.vector.slice()}
+	}
+	return &expression{list: &list{first: x, rest: seq, count: 1 + seqLen(seq)}}
+}
+
+// seqLen returns the number of items of a list or vector.
+func seqLen(expr *expression) int {
+	switch {
+	case expr.list != nil:
+		return expr.list.count
+	case expr.vector != nil:
+		return expr.vector.count
+	}
+	return len(expr.expressions)
+}
+
+// first and rest return the head and tail of a list or vector. The rest of
+// an empty sequence is the empty list.
+func first(expr *expression) *expression {
+	switch {
+	case expr.list != nil:
+		return expr.list.first
+	case expr.vector != nil:
+		if expr.vector.count == 0 {
+			return nil
+		}
+		return expr.vector.nth(0)
+	case len(expr.expressions) > 0:
+		return expr.expressions[0]
+	}
+	return nil
+}
+
+func rest(expr *expression) *expression {
+	switch {
+	case expr.list != nil:
+		return expr.list.rest
+	case expr.vector != nil:
+		if expr.vector.count == 0 {
+			return emptyList
+		}
+		return &expression{expressions: expr.vector.slice()[1:]}
+	case len(expr.expressions) > 0:
+		return &expression{expressions: expr.expressions[1:]}
+	}
+	return emptyList
+}
+
+// index returns the vector index held by key, if it is an integer.
+func index(key *expression) (int, bool) {
+	if key == nil || key.atom == nil || key.atom.integer == nil {
+		return 0, false
+	}
+	return *key.atom.integer, true
+}
+
+const (
+	vecBits  = 5
+	vecWidth = 1 << vecBits
+	vecMask  = vecWidth - 1
+)
+
+// vector is an indexable sequence, written as [a b c]. It is a 32-way trie
+// with the last, incomplete leaf kept apart as the tail, so lookup and update
+// take O(log32 n) and conj amortized constant time.
+type vector struct {
+	count int
+	shift uint
+	root  *vecNode
+	tail  []*expression
+}
+
+// vecNode is a node of the vector trie, a branch with nodes or a leaf with
+// vecWidth elems.
+type vecNode struct {
+	nodes [vecWidth]*vecNode
+	elems []*expression
+}
+
+var emptyVector = &vector{shift: vecBits, root: &vecNode{}}
+
+func newVector(elems []*expression) *vector {
+	v := emptyVector
+	for _, e := range elems {
+		v = v.conj(e)
+	}
+	return v
+}
+
+// tailOffset returns the index of the first element of the tail.
+func (v *vector) tailOffset() int {
+	if v.count < vecWidth {
+		return 0
+	}
+	return ((v.count - 1) >> vecBits) << vecBits
+}
+
+// leaf returns the elements of the leaf or tail holding index i.
+func (v *vector) leaf(i int) []*expression {
+	if i >= v.tailOffset() {
+		return v.tail
+	}
+	n := v.root
+	for level := v.shift; level > 0; level -= vecBits {
+		n = n.nodes[(i>>level)&vecMask]
+	}
+	return n.elems
+}
+
+// nth returns the element at index i, which must be in range.
+func (v *vector) nth(i int) *expression {
+	return v.leaf(i)[i&vecMask]
+}
+
+// slice returns the elements of v.
+func (v *vector) slice() []*expression {
+	elems := make([]*expression, 0, v.count)
+	for i := 0; i < v.count; i += vecWidth {
+		elems = append(elems, v.leaf(i)...)
+	}
+	return elems
+}
+
+// conj returns v with x appended.
+func (v *vector) conj(x *expression) *vector {
+	if v.count-v.tailOffset() < vecWidth {
+		tail := make([]*expression, len(v.tail), len(v.tail)+1)
+		copy(tail, v.tail)
+		return &vector{count: v.count + 1, shift: v.shift, root: v.root, tail: append(tail, x)}
+	}
+
+	// the tail is full, push it into the trie
+	tailNode := &vecNode{elems: v.tail}
+	shift := v.shift
+	var root *vecNode
+	if (v.count >> vecBits) > (1 << v.shift) {
+		// the trie is full, add a level
+		root = &vecNode{}
+		root.nodes[0] = v.root
+		root.nodes[1] = newPath(v.shift, tailNode)
+		shift += vecBits
+	} else {
+		root = v.pushTail(v.shift, v.root, tailNode)
+	}
+	return &vector{count: v.count + 1, shift: shift, root: root, tail: []*expression{x}}
+}
+
+func (v *vector) pushTail(level uint, parent, tailNode *vecNode) *vecNode {
+	n := *parent
+	i := ((v.count - 1) >> level) & vecMask
+	switch {
+	case level == vecBits:
+		n.nodes[i] = tailNode
+	case parent.nodes[i] != nil:
+		n.nodes[i] = v.pushTail(level-vecBits, parent.nodes[i], tailNode)
+	default:
+		n.nodes[i] = newPath(level-vecBits, tailNode)
+	}
+	return &n
+}
+
+func newPath(level uint, n *vecNode) *vecNode {
+	if level == 0 {
+		return n
+	}
+	p := &vecNode{}
+	p.nodes[0] = newPath(level-vecBits, n)
+	return p
+}
+
+// assoc returns v with the element at index i, which must be in range or
+// one past the end, set to x.
+func (v *vector) assoc(i int, x *expression) *vector {
+	if i == v.count {
+		return v.conj(x)
+	}
+	if i >= v.tailOffset() {
+		tail := append([]*expression(nil), v.tail...)
+		tail[i&vecMask] = x
+		return &vector{count: v.count, shift: v.shift, root: v.root, tail: tail}
+	}
+	return &vector{count: v.count, shift: v.shift, root: assocNode(v.shift, v.root, i, x), tail: v.tail}
+}
+
+func assocNode(level uint, node *vecNode, i int, x *expression) *vecNode {
+	n := *node
+	if level == 0 {
+		n.elems = append([]*expression(nil), node.elems...)
+		n.elems[i&vecMask] = x
+	} else {
+		sub := (i >> level) & vecMask
+		n.nodes[sub] = assocNode(level-vecBits, node.nodes[sub], i, x)
+	}
+	return &n
+}
+
+// hamt is a hash array mapped trie, the structure behind hashMap and
+// hashSet. Each level consumes 5 bits of the key hash, keys whose hashes
+// are equal share a collision node.
+type hamt struct {
+	count int
+	root  *hamtNode
+}
+
+type hamtNode struct {
+	bitmap  uint32
+	entries []hamtEntry // one per bit set in bitmap, in bit order
+
+	// collision nodes hold entries with the same hash, bitmap is unused
+	collision bool
+}
+
+// hamtEntry is a key and value, or a node one level down.
+type hamtEntry struct {
+	hash     uint32
+	key, val *expression
+	node     *hamtNode
+}
+
+func (h hamt) get(key *expression) (*expression, bool) {
+	hash := hashExpr(key)
+	n := h.root
+	for shift := uint(0); n != nil; shift += vecBits {
+		if n.collision {
+			for _, e := range n.entries {
+				if equal(e.key, key) {
+					return e.val, true
+				}
+			}
+			return nil, false
+		}
+		bit := uint32(1) << ((hash >> shift) & vecMask)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+		e := n.entries[bits.OnesCount32(n.bitmap&(bit-1))]
+		if e.node == nil {
+			if equal(e.key, key) {
+				return e.val, true
+			}
+			return nil, false
+		}
+		n = e.node
+	}
+	return nil, false
+}
+
+func (h hamt) assoc(key, val *expression) hamt {
+	e := hamtEntry{hash: hashExpr(key), key: key, val: val}
+	if h.root == nil {
+		h.root = &hamtNode{}
+	}
+	root, added := h.root.assoc(0, e)
+	if added {
+		h.count++
+	}
+	h.root = root
+	return h
+}
+
+func (n *hamtNode) assoc(shift uint, leaf hamtEntry) (*hamtNode, bool) {
+	if n.collision {
+		c := &hamtNode{collision: true, entries: append([]hamtEntry(nil), n.entries...)}
+		for i, e := range c.entries {
+			if equal(e.key, leaf.key) {
+				c.entries[i] = leaf
+				return c, false
+			}
+		}
+		c.entries = append(c.entries, leaf)
+		return c, true
+	}
+
+	bit := uint32(1) << ((leaf.hash >> shift) & vecMask)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		entries := make([]hamtEntry, 0, len(n.entries)+1)
+		entries = append(entries, n.entries[:i]...)
+		entries = append(entries, leaf)
+		entries = append(entries, n.entries[i:]...)
+		return &hamtNode{bitmap: n.bitmap | bit, entries: entries}, true
+	}
+
+	c := &hamtNode{bitmap: n.bitmap, entries: append([]hamtEntry(nil), n.entries...)}
+	e := n.entries[i]
+	added := true
+	switch {
+	case e.node != nil:
+		var sub *hamtNode
+		sub, added = e.node.assoc(shift+vecBits, leaf)
+		c.entries[i] = hamtEntry{node: sub}
+	case equal(e.key, leaf.key):
+		c.entries[i] = leaf
+		added = false
+	default:
+		c.entries[i] = hamtEntry{node: mergeLeaves(shift+vecBits, e, leaf)}
+	}
+	return c, added
+}
+
+// mergeLeaves returns a node holding two leaves with different keys.
+func mergeLeaves(shift uint, a, b hamtEntry) *hamtNode {
+	if a.hash == b.hash {
+		return &hamtNode{collision: true, entries: []hamtEntry{a, b}}
+	}
+	ia, ib := (a.hash>>shift)&vecMask, (b.hash>>shift)&vecMask
+	switch {
+	case ia == ib:
+		return &hamtNode{bitmap: 1 << ia, entries: []hamtEntry{{node: mergeLeaves(shift+vecBits, a, b)}}}
+	case ia < ib:
+		return &hamtNode{bitmap: 1<<ia | 1<<ib, entries: []hamtEntry{a, b}}
+	}
+	return &hamtNode{bitmap: 1<<ia | 1<<ib, entries: []hamtEntry{b, a}}
+}
+
+func (h hamt) dissoc(key *expression) hamt {
+	if h.root == nil {
+		return h
+	}
+	root, removed := h.root.dissoc(0, hashExpr(key), key)
+	if removed {
+		h.count--
+		h.root = root
+	}
+	return h
+}
+
+// dissoc returns n without key, nil if that leaves it empty.
+func (n *hamtNode) dissoc(shift uint, hash uint32, key *expression) (*hamtNode, bool) {
+	if n.collision {
+		for i, e := range n.entries {
+			if equal(e.key, key) {
+				if len(n.entries) == 1 {
+					return nil, true
+				}
+				entries := append(append([]hamtEntry(nil), n.entries[:i]...), n.entries[i+1:]...)
+				return &hamtNode{collision: true, entries: entries}, true
+			}
+		}
+		return n, false
+	}
+
+	bit := uint32(1) << ((hash >> shift) & vecMask)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	e := n.entries[i]
+	if e.node != nil {
+		sub, removed := e.node.dissoc(shift+vecBits, hash, key)
+		if !removed {
+			return n, false
+		}
+		if sub != nil {
+			c := &hamtNode{bitmap: n.bitmap, entries: append([]hamtEntry(nil), n.entries...)}
+			c.entries[i] = hamtEntry{node: sub}
+			return c, true
+		}
+	} else if !equal(e.key, key) {
+		return n, false
+	}
+
+	if len(n.entries) == 1 {
+		return nil, true
+	}
+	entries := append(append([]hamtEntry(nil), n.entries[:i]...), n.entries[i+1:]...)
+	return &hamtNode{bitmap: n.bitmap &^ bit, entries: entries}, true
+}
+
+// each calls fn for every key and value, in hash order.
+func (h hamt) each(fn func(key, val *expression)) {
+	if h.root != nil {
+		h.root.each(fn)
+	}
+}
+
+func (n *hamtNode) each(fn func(key, val *expression)) {
+	for _, e := range n.entries {
+		if e.node != nil {
+			e.node.each(fn)
+		} else {
+			fn(e.key, e.val)
+		}
+	}
+}
+
+// hashMap maps keys to values, keys are compared with equal.
+type hashMap struct {
+	hamt
+}
+
+func (m *hashMap) assoc(key, val *expression) *hashMap {
+	return &hashMap{m.hamt.assoc(key, val)}
+}
+
+func (m *hashMap) dissoc(key *expression) *hashMap {
+	return &hashMap{m.hamt.dissoc(key)}
+}
+
+// hashSet is a set of values compared with equal.
+type hashSet struct {
+	hamt
+}
+
+func (s *hashSet) contains(key *expression) bool {
+	_, ok := s.get(key)
+	return ok
+}
+
+func (s *hashSet) conj(key *expression) *hashSet {
+	return &hashSet{s.hamt.assoc(key, key)}
+}
+
+func (s *hashSet) disj(key *expression) *hashSet {
+	return &hashSet{s.hamt.dissoc(key)}
+}
+
+// walkColl returns a copy of the map or set expr with fn applied to every
+// key and value, as done to evaluate or expand a literal.
+func walkColl(expr *expression, fn func(*expression) (*expression, error)) (*expression, error) {
+	var err error
+	walk := func(e *expression) *expression {
+		if err != nil {
+			return nil
+		}
+		var r *expression
+		r, err = fn(e)
+		return r
+	}
+
+	if expr.set != nil {
+		set := &hashSet{}
+		expr.set.each(func(k, _ *expression) {
+			set = set.conj(walk(k))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &expression{set: set, pos: expr.pos}, nil
+	}
+
+	m := &hashMap{}
+	expr.hashMap.each(func(k, v *expression) {
+		m = m.assoc(walk(k), walk(v))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &expression{hashMap: m, pos: expr.pos}, nil
+}
+
+// hashExpr hashes a value consistently with equal: equal values have equal
+// hashes. Numbers hash by their float64 value, lists and vectors alike.
+func hashExpr(expr *expression) uint32 {
+	h := fnv.New32a()
+	switch {
+	case expr == nil:
+		return 0
+	case isNumber(expr):
+		f := toFloat(expr.atom)
+		if c := expr.atom.complex; c != nil {
+			if imag(*c) != 0 {
+				return hashFloat(real(*c))*31 + hashFloat(imag(*c))
+			}
+			f = real(*c)
+		}
+		return hashFloat(f)
+	case expr.atom != nil:
+		a := expr.atom
+		switch {
+		case a.str != nil:
+			h.Write([]byte("s" + *a.str))
+		case a.symbol != nil:
+			h.Write([]byte("y" + *a.symbol))
+		case a.keyword != nil:
+			h.Write([]byte("k" + *a.keyword))
+		case a.char != nil:
+			return uint32(*a.char) * 16777619
+		case a.boolean != nil && *a.boolean:
+			return 1231
+		case a.boolean != nil:
+			return 1237
+		}
+		return h.Sum32()
+	case expr.hashMap != nil:
+		var sum uint32
+		expr.hashMap.each(func(k, v *expression) {
+			sum += hashExpr(k) ^ hashExpr(v)
+		})
+		return sum
+	case expr.set != nil:
+		var sum uint32
+		expr.set.each(func(k, _ *expression) {
+			sum += hashExpr(k)
+		})
+		return sum
+	case expr.handle != nil:
+		h.Write([]byte(expr.handle.v.Type().String()))
+		return h.Sum32()
+	case isFunc(expr) || expr.err != nil:
+		return 0
+	}
+	sum := uint32(1)
+	for _, e := range elements(expr) {
+		sum = sum*31 + hashExpr(e)
+	}
+	return sum
+}
+
+func hashFloat(f float64) uint32 {
+	if f == 0 {
+		f = 0 // -0 equals 0
+	}
+	b := math.Float64bits(f)
+	return uint32(b ^ b>>32)
+}
@@ -0,0 +1,200 @@
+package interp
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	exprType = reflect.TypeOf((*expression)(nil))
+	chanType = reflect.TypeOf((chan *expression)(nil))
+)
+
+// spawn calls proc with args in a new goroutine. It returns a channel that
+// receives the result, or an error value if proc fails, once it returns.
+func spawn(env *environment, proc *expression, args []*expression) *expression {
+	done := make(chan *expression, 1)
+	go func() {
+		result, err := func() (result *expression, err error) {
+			defer recoverError(&err)
+			return apply(env, proc, args)
+		}()
+		if err != nil {
+			result = caught(err)
+		}
+		done <- result
+	}()
+	return &expression{handle: &handle{reflect.ValueOf(done)}}
+}
+
+// newChan returns a channel of tipi values with the given buffer size.
+func newChan(size int) *expression {
+	return &expression{handle: &handle{reflect.ValueOf(make(chan *expression, size))}}
+}
+
+// chanArg returns the channel held by e, a tipi channel or one from Go.
+func chanArg(name string, e *expression) (reflect.Value, error) {
+	if e == nil || e.handle == nil || e.handle.v.Kind() != reflect.Chan {
+		return reflect.Value{}, newError(TypeError, "%s: not a channel: %s", name, exprToString(e))
+	}
+	return e.handle.v, nil
+}
+
+// toChan converts v to the element type of ch.
+func toChan(env *environment, ch reflect.Value, v *expression) (reflect.Value, error) {
+	if ch.Type().Elem() == exprType {
+		return reflect.ValueOf(v), nil
+	}
+	return toReflect(env, nil, v, ch.Type().Elem())
+}
+
+// fromChan converts a value received from a channel.
+func fromChan(v reflect.Value) *expression {
+	if v.Type() == exprType {
+		return v.Interface().(*expression)
+	}
+	return fromReflect(v)
+}
+
+// chanSelect blocks until one of cases can proceed, or the evaluation in
+// progress is cancelled.
+func chanSelect(env *environment, cases []reflect.SelectCase) (chosen int, recv reflect.Value, recvOK bool, err error) {
+	ctx := env.context()
+	if ctx != nil {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ctx.Done()),
+		})
+	}
+	chosen, recv, recvOK = reflect.Select(cases)
+	if ctx != nil && chosen == len(cases)-1 {
+		return 0, reflect.Value{}, false, ctx.Err()
+	}
+	return chosen, recv, recvOK, nil
+}
+
+// send sends v on ch, (send ch v).
+func send(env *environment, ch reflect.Value, v *expression) (err error) {
+	// sending on a closed channel panics
+	defer recoverError(&err)
+
+	x, err := toChan(env, ch, v)
+	if err != nil {
+		return newError(TypeError, "send: %v", err)
+	}
+	_, _, _, err = chanSelect(env, []reflect.SelectCase{{Dir: reflect.SelectSend, Chan: ch, Send: x}})
+	return err
+}
+
+// recv receives a value from ch, (recv ch). It returns nil once ch is
+// closed and drained.
+func recv(env *environment, ch reflect.Value) (*expression, error) {
+	_, v, ok, err := chanSelect(env, []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return fromChan(v), nil
+}
+
+// evalSelect evaluates
+//
+//	(select
+//	  (recv ch v body...)
+//	  (send ch x body...)
+//	  (default body...))
+//
+// It waits until one of the channel operations can proceed and evaluates the
+// body of its clause, with v bound to the received value. The default
+// clause, if any, is taken when no operation is ready.
+func evalSelect(env *environment, expr *expression, depth int) (result *expression, err error) {
+	// sending on a closed channel panics
+	defer recoverError(&err)
+
+	// Go would block forever, or abort the process if nothing else runs
+	if len(expr.expressions) == 1 {
+		return nil, errorAt(newError(SyntaxError, "select: no clauses"), expr.pos)
+	}
+
+	var cases []reflect.SelectCase
+	var bodies [][]*expression
+	var names []string
+	for _, clause := range expr.expressions[1:] {
+		var op string
+		if clause != nil && len(clause.expressions) > 0 {
+			op, _ = symbolArg("select", clause.expressions[0])
+		}
+		malformed := errorAt(newError(SyntaxError, "select: malformed clause: %s", exprToString(clause)), expr.pos)
+
+		var c reflect.SelectCase
+		var name string
+		var body []*expression
+		switch op {
+		case "recv", "send":
+			if len(clause.expressions) < 3 {
+				return nil, malformed
+			}
+			chExpr, err := evalAt(env, clause.expressions[1], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			ch, err := chanArg("select", chExpr)
+			if err != nil {
+				return nil, errorAt(err, clause.pos)
+			}
+			c.Chan = ch
+			body = clause.expressions[3:]
+			if op == "recv" {
+				c.Dir = reflect.SelectRecv
+				if name, err = symbolArg("select", clause.expressions[2]); err != nil {
+					return nil, errorAt(err, clause.pos)
+				}
+				break
+			}
+			c.Dir = reflect.SelectSend
+			v, err := evalAt(env, clause.expressions[2], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if c.Send, err = toChan(env, ch, v); err != nil {
+				return nil, errorAt(newError(TypeError, "select: %v", err), clause.pos)
+			}
+		case "default":
+			c.Dir = reflect.SelectDefault
+			body = clause.expressions[1:]
+		default:
+			return nil, malformed
+		}
+		cases = append(cases, c)
+		bodies = append(bodies, body)
+		names = append(names, name)
+	}
+
+	chosen, v, ok, err := chanSelect(env, cases)
+	if err != nil {
+		return nil, errorAt(err, expr.pos)
+	}
+
+	scope := env
+	if names[chosen] != "" {
+		var received *expression
+		if ok {
+			received = fromChan(v)
+		}
+		scope = &environment{
+			parent: env,
+			values: map[string]*expression{names[chosen]: received},
+			depth:  depth,
+		}
+	}
+	return evalBody(scope, bodies[chosen], depth)
+}
+
+// newWaitGroup and newMutex return Go sync primitives, used through method
+// calls like (.Wait wg) and (.Lock mu).
+func newWaitGroup() *expression {
+	return &expression{handle: &handle{reflect.ValueOf(new(sync.WaitGroup))}}
+}
+
+func newMutex() *expression {
+	return &expression{handle: &handle{reflect.ValueOf(new(sync.Mutex))}}
+}
@@ -0,0 +1,193 @@
+package interp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"neugram.io/ng/eval/gowrap"
+	_ "neugram.io/ng/eval/gowrap/wrapbuiltin"
+)
+
+// environment is a scope. Values and macros share one namespace, the nearest
+// binding of a name wins. The environment of a file also records its
+// namespace and the namespaces it required, the root environment holds the
+// builtins and the module cache. Environments are shared by goroutines, mu
+// guards the maps and ctx.
+type environment struct {
+	mu      sync.RWMutex
+	values  map[string]*expression
+	macros  map[string]*expression
+	aliases map[string]*namespace
+	parent  *environment
+
+	ns      *namespace
+	modules *modules
+	ctx     context.Context // of the evaluation in progress
+	onError func(error)     // given errors that can't be raised, nil for stderr
+	depth   int             // levels of evaluation this frame is nested in
+}
+
+// get returns the value bound to name in this frame.
+func (e *environment) get(name string) (*expression, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	v, ok := e.values[name]
+	return v, ok
+}
+
+// getMacro returns the macro bound to name in this frame.
+func (e *environment) getMacro(name string) (*expression, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	m, ok := e.macros[name]
+	return m, ok
+}
+
+// define binds name to v in this frame, replacing a macro of the same name.
+func (e *environment) define(name string, v *expression) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.values == nil {
+		e.values = map[string]*expression{}
+	}
+	e.values[name] = v
+	delete(e.macros, name)
+}
+
+// assign rebinds name in the nearest frame that binds it, as done by set!.
+// It reports whether name was bound.
+func (e *environment) assign(name string, v *expression) bool {
+	for s := e; s != nil; s = s.parent {
+		s.mu.Lock()
+		_, ok := s.values[name]
+		if ok {
+			s.values[name] = v
+		}
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// context returns the context of the evaluation in progress, nil if there
+// is none.
+func (e *environment) context() context.Context {
+	r := e.root()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ctx
+}
+
+// reportError hands err, raised where no tipi code can catch it, to the
+// error handler of the Interpreter. Without one it is written to os.Stderr.
+func (e *environment) reportError(err error) {
+	r := e.root()
+	r.mu.RLock()
+	handler := r.onError
+	r.mu.RUnlock()
+	if handler == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	handler(err)
+}
+
+func (e *environment) setContext(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ctx = ctx
+}
+
+// lookupMacro returns the macro bound to name, or nil if name isn't a macro
+// or is shadowed by a value in a nearer scope. alias.name finds a macro in a
+// required namespace.
+func (e *environment) lookupMacro(name string) *expression {
+	for s := e; s != nil; s = s.parent {
+		if _, ok := s.get(name); ok {
+			return nil
+		}
+		if m, ok := s.getMacro(name); ok {
+			return m
+		}
+	}
+	if split := strings.SplitN(name, ".", 2); len(split) == 2 {
+		if ns := e.lookupAlias(split[0]); ns != nil {
+			m, _ := ns.env.getMacro(split[1])
+			return m
+		}
+	}
+	return nil
+}
+
+func (e *environment) defineMacro(name string, macro *expression) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.macros == nil {
+		e.macros = map[string]*expression{}
+	}
+	e.macros[name] = macro
+	delete(e.values, name)
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (e *environment) lookup(key string) (*expression, error) {
+	for s := e; s != nil; s = s.parent {
+		if v, ok := s.get(key); ok {
+			return v, nil
+		}
+	}
+
+	// fmt.Println("LOOKUP", key)
+
+	// (.Method obj args...) and (.-Field obj)
+	switch {
+	case strings.HasPrefix(key, ".-") && len(key) > 2:
+		return fieldFunc(key[2:]), nil
+	case strings.HasPrefix(key, ".") && len(key) > 1:
+		return methodFunc(key[1:]), nil
+	}
+
+	unbound := newError(UnboundSymbolError, "unbound symbol: %s", key)
+	split := strings.SplitN(key, ".", 2)
+	if len(split) != 2 {
+		return nil, unbound
+	}
+	pkg, fun := split[0], split[1]
+
+	// a required tipi namespace shadows a Go package of the same name
+	if ns := e.lookupAlias(pkg); ns != nil {
+		if v, ok := ns.env.get(fun); ok {
+			return v, nil
+		}
+		return nil, unbound
+	}
+
+	stdlib := gowrap.Pkgs
+	stdlibPkg := stdlib[pkg]
+	if stdlibPkg == nil {
+		return nil, unbound
+	}
+	export := stdlibPkg.Exports[fun]
+	if !export.IsValid() {
+		return nil, unbound
+	}
+	switch {
+	case export.Kind() == reflect.Func:
+		return goFunc(key, export), nil
+	case export.Type().Implements(reflectTypeType):
+		// a type, for use with new
+		return &expression{handle: &handle{export}}, nil
+	case export.Kind() == reflect.Ptr:
+		// the address of a package variable, read its current value
+		return fromReflect(export.Elem()), nil
+	}
+	// a constant
+	return fromReflect(export), nil
+}
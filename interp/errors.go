@@ -0,0 +1,242 @@
+package interp
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/robbiev/tipi/lexer"
+)
+
+// source is the text a form was read from.
+type source struct {
+	name string
+	text string
+	line int // lines preceding text, when it is a chunk of a stream
+	col  int // bytes preceding text on its first line
+}
+
+func newSource(name, text string) *source {
+	return &source{name: name, text: text}
+}
+
+// position returns the position of item in s.
+func (s *source) position(item lexer.Item) *Position {
+	col := item.Col
+	if item.Line == 1 {
+		col += s.col
+	}
+	return &Position{
+		File: s.name,
+		Line: s.line + item.Line,
+		Col:  col,
+	}
+}
+
+// Position is a location in tipi source, lines and columns start at 1.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p *Position) String() string {
+	file := p.File
+	if file == "" {
+		file = "<stdin>"
+	}
+	return fmt.Sprintf("%s:%d:%d", file, p.Line, p.Col)
+}
+
+// ErrorKind classifies an Error.
+type ErrorKind int
+
+const (
+	RuntimeError ErrorKind = iota
+	SyntaxError
+	UnboundSymbolError
+	ArityError
+	TypeError
+)
+
+// Error is the error returned when reading or evaluating tipi code fails. Pos
+// is the innermost known source position, nil if none is known, and Stack
+// holds the tipi calls that were active when the error happened, innermost
+// first.
+type Error struct {
+	Kind  ErrorKind
+	Msg   string
+	Pos   *Position
+	Stack []Frame
+
+	// thrown is the value passed to throw, if any
+	thrown *expression
+}
+
+// Frame is a call in an Error's stack trace.
+type Frame struct {
+	Name string
+	Pos  *Position
+}
+
+func (e *Error) Error() string {
+	if e.Pos == nil {
+		return e.Msg
+	}
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// ErrorList is a list of errors, like all the lexical errors found in a file.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	var buf bytes.Buffer
+	for i, e := range l {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(e.Error())
+	}
+	return buf.String()
+}
+
+// err returns nil for an empty list, the error itself for a list of one and
+// the list otherwise.
+func (l ErrorList) err() error {
+	switch len(l) {
+	case 0:
+		return nil
+	case 1:
+		return l[0]
+	}
+	return l
+}
+
+// maxStackFrames limits how much of a deep recursion is kept in a trace.
+const maxStackFrames = 64
+
+// StackTrace formats the tipi call stack, innermost call first.
+func (e *Error) StackTrace() string {
+	var buf bytes.Buffer
+	for i, f := range e.Stack {
+		if i == maxStackFrames {
+			fmt.Fprintf(&buf, "\t... %d more\n", len(e.Stack)-i)
+			break
+		}
+		if f.Pos == nil {
+			fmt.Fprintf(&buf, "\tat %s\n", f.Name)
+		} else {
+			fmt.Fprintf(&buf, "\tat %s (%s)\n", f.Name, f.Pos)
+		}
+	}
+	return buf.String()
+}
+
+func newError(kind ErrorKind, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// errorAt returns err as an *Error, using pos if no position is known yet.
+func errorAt(err error, pos *Position) *Error {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Kind: RuntimeError, Msg: err.Error()}
+	}
+	if e.Pos == nil {
+		e.Pos = pos
+	}
+	return e
+}
+
+// callError records a call to name at pos on err.
+func callError(err error, name string, pos *Position) *Error {
+	e := errorAt(err, pos)
+	e.Stack = append(e.Stack, Frame{Name: name, Pos: pos})
+	return e
+}
+
+// copyError returns a copy of err if it is an *Error, so that an error raised
+// again, by every requirer of a failed load or by a rethrow, gets stack frames
+// of its own.
+func copyError(err error) error {
+	e, ok := err.(*Error)
+	if !ok {
+		return err
+	}
+	c := *e
+	c.Stack = append([]Frame(nil), e.Stack...)
+	return &c
+}
+
+// recoverError turns a Go panic into an error, it must be deferred directly.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		// Go code panicking with the error of a tipi callback
+		if e, ok := r.(*Error); ok {
+			*err = e
+			return
+		}
+		if e, ok := r.(error); ok {
+			*err = newError(RuntimeError, "go panic: %v", e)
+		} else {
+			*err = newError(RuntimeError, "go panic: %v", r)
+		}
+	}
+}
+
+func checkArity(name string, args []*expression, min, max int) error {
+	if len(args) >= min && (max < 0 || len(args) <= max) {
+		return nil
+	}
+	var want string
+	switch {
+	case min == max:
+		want = fmt.Sprint(min)
+	case max < 0:
+		want = fmt.Sprintf("at least %d", min)
+	default:
+		want = fmt.Sprintf("%d to %d", min, max)
+	}
+	return newError(ArityError, "%s: wrong number of arguments: want %s, got %d", name, want, len(args))
+}
+
+func intArg(name string, e *expression) (int, error) {
+	if e == nil || e.atom == nil || e.atom.integer == nil {
+		return 0, newError(TypeError, "%s: not an integer: %s", name, exprToString(e))
+	}
+	return *e.atom.integer, nil
+}
+
+func strArg(name string, e *expression) (string, error) {
+	if e == nil || e.atom == nil || e.atom.str == nil {
+		return "", newError(TypeError, "%s: not a string: %s", name, exprToString(e))
+	}
+	return *e.atom.str, nil
+}
+
+func symbolArg(name string, e *expression) (string, error) {
+	if e == nil || e.atom == nil || e.atom.symbol == nil {
+		return "", newError(SyntaxError, "%s: not a symbol: %s", name, exprToString(e))
+	}
+	return *e.atom.symbol, nil
+}
+
+// countArg returns the number of items of a collection.
+func countArg(name string, e *expression) (int, error) {
+	switch {
+	case isSeq(e):
+		return seqLen(e), nil
+	case e != nil && e.hashMap != nil:
+		return e.hashMap.count, nil
+	case e != nil && e.set != nil:
+		return e.set.count, nil
+	}
+	return 0, newError(TypeError, "%s: not a collection: %s", name, exprToString(e))
+}
+
+// seqArg returns the elements of a list or vector.
+func seqArg(name string, e *expression) ([]*expression, error) {
+	if !isSeq(e) {
+		return nil, newError(TypeError, "%s: not a list or vector: %s", name, exprToString(e))
+	}
+	return elements(e), nil
+}
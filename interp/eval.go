@@ -0,0 +1,717 @@
+package interp
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// eval evaluates expr in env, one level deeper than env.
+func eval(env *environment, expr *expression) (*expression, error) {
+	return evalAt(env, expr, env.depth+1)
+}
+
+// evalAt evaluates expr in env, depth levels deep. Tail positions, the
+// branches of if, the last form of do and the body of a func, are evaluated
+// by looping rather than recursing so tail calls run in constant Go stack.
+// Every other evaluation of a subform is a level deeper.
+func evalAt(env *environment, expr *expression, depth int) (*expression, error) {
+	// call is the func call currently being evaluated by the loop, it is added
+	// to the stack trace of any error
+	var call *Frame
+	fail := func(err error) (*expression, error) {
+		if call != nil {
+			return nil, callError(err, call.Name, call.Pos)
+		}
+		return nil, err
+	}
+
+	for {
+		// TODO(robbiev): only needed since expand() and def-macro returning nil there
+		if expr == nil {
+			return nil, nil
+		}
+		if depth > maxDepth {
+			return fail(errorAt(newError(RuntimeError, "stack overflow: evaluation nested more than %d deep", maxDepth), expr.pos))
+		}
+
+		if expr.atom != nil {
+			if expr.atom.symbol != nil {
+				v, err := env.lookup(*expr.atom.symbol)
+				if err != nil {
+					return fail(errorAt(err, expr.pos))
+				}
+				return v, nil
+			}
+
+			// numeric constant
+			return expr, nil
+		}
+
+		// map and set literals evaluate their keys and values
+		if expr.hashMap != nil || expr.set != nil {
+			result, err := walkColl(expr, func(e *expression) (*expression, error) {
+				return evalAt(env, e, depth+1)
+			})
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		}
+
+		if !isSeq(expr) {
+			return expr, nil
+		}
+
+		if expr.vector != nil {
+			v := emptyVector
+			for _, e := range expr.vector.slice() {
+				x, err := evalAt(env, e, depth+1)
+				if err != nil {
+					return fail(err)
+				}
+				v = v.conj(x)
+			}
+			return &expression{vector: v}, nil
+		}
+
+		// a list built at runtime, as passed to eval
+		if expr.list != nil {
+			expr = &expression{expressions: elements(expr), pos: expr.pos}
+		}
+
+		if len(expr.expressions) == 0 {
+			return fail(errorAt(newError(SyntaxError, "cannot evaluate the empty list"), expr.pos))
+		}
+
+		var actor string
+		if actorAtom := expr.expressions[0].atom; actorAtom != nil && actorAtom.symbol != nil {
+			actor = *actorAtom.symbol
+		}
+
+		switch actor {
+		case "if":
+			if err := checkForm(expr, 3, 4); err != nil {
+				return fail(err)
+			}
+			test, err := evalAt(env, expr.expressions[1], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			if test == nil || test.atom == nil || test.atom.boolean == nil {
+				return fail(errorAt(newError(TypeError, "if: test is not a boolean: %s", exprToString(test)), expr.expressions[1].pos))
+			}
+			switch {
+			case *test.atom.boolean:
+				expr = expr.expressions[2]
+			case len(expr.expressions) == 4:
+				expr = expr.expressions[3]
+			default:
+				return nil, nil
+			}
+			continue
+		case "do":
+			if len(expr.expressions) == 1 {
+				return nil, nil
+			}
+			body := expr.expressions[1:]
+			for _, e := range body[:len(body)-1] {
+				if _, err := evalAt(env, e, depth+1); err != nil {
+					return fail(err)
+				}
+			}
+			expr = body[len(body)-1]
+			continue
+		case "cons":
+			if err := checkForm(expr, 3, 3); err != nil {
+				return fail(err)
+			}
+			seq, err := evalAt(env, expr.expressions[2], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			// checked without walking the list, the new cell shares it
+			if seq != nil && !isSeq(seq) {
+				return fail(errorAt(newError(TypeError, "cons: not a list or vector: %s", exprToString(seq)), expr.pos))
+			}
+			x, err := evalAt(env, expr.expressions[1], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			return cons(x, seq), nil
+		case "def":
+			if err := checkForm(expr, 3, 3); err != nil {
+				return fail(err)
+			}
+			name, err := symbolArg("def", expr.expressions[1])
+			if err != nil {
+				return fail(errorAt(err, expr.pos))
+			}
+			v, err := evalAt(env, expr.expressions[2], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			// def binds in the namespace, even from a function body
+			env.global().define(name, v)
+			// TODO(robbiev) anything to return?
+			return nil, nil
+		case "set!":
+			if err := checkForm(expr, 3, 3); err != nil {
+				return fail(err)
+			}
+			name, err := symbolArg("set!", expr.expressions[1])
+			if err != nil {
+				return fail(errorAt(err, expr.pos))
+			}
+			v, err := evalAt(env, expr.expressions[2], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			if !env.assign(name, v) {
+				return fail(errorAt(newError(UnboundSymbolError, "set!: unbound symbol: %s", name), expr.pos))
+			}
+			return nil, nil
+		case "ns":
+			if err := checkForm(expr, 2, 2); err != nil {
+				return fail(err)
+			}
+			name, err := symbolArg("ns", expr.expressions[1])
+			if err != nil {
+				return fail(errorAt(err, expr.pos))
+			}
+			if ns := env.namespace(); ns != nil {
+				ns.name = name
+			}
+			return nil, nil
+		case "require":
+			result, err := evalRequire(env, expr, depth)
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		case "def-macro":
+			// expand has already evaluated the macro function
+			if err := checkForm(expr, 3, 3); err != nil {
+				return fail(err)
+			}
+			name, err := symbolArg("def-macro", expr.expressions[1])
+			if err != nil {
+				return fail(errorAt(err, expr.pos))
+			}
+			macro, err := evalAt(env, expr.expressions[2], depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			if !isFunc(macro) {
+				return fail(errorAt(newError(TypeError, "def-macro: not a function: %s", exprToString(macro)), expr.pos))
+			}
+			env.defineMacro(name, macro)
+			return nil, nil
+		case "quote":
+			if err := checkForm(expr, 2, 2); err != nil {
+				return fail(err)
+			}
+			return expr.expressions[1], nil
+		case "quasiquote":
+			if err := checkForm(expr, 2, 2); err != nil {
+				return fail(err)
+			}
+			// unquoted forms are evaluated a level deeper, in a frame of
+			// their own that records it
+			inner := &environment{parent: env, depth: depth}
+			result, err := quasiquote(inner, expr.expressions[1], map[string]*expression{}, 1)
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		case "select":
+			result, err := evalSelect(env, expr, depth)
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		case "try":
+			result, err := evalTry(env, expr, depth)
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		case "func":
+			if err := checkForm(expr, 3, 3); err != nil {
+				return fail(err)
+			}
+			result, err := makeFunc(env, expr)
+			if err != nil {
+				return fail(err)
+			}
+			return result, nil
+		}
+
+		proc, err := evalAt(env, expr.expressions[0], depth+1)
+		if err != nil {
+			return fail(err)
+		}
+		if _, ok := keywordName(proc); ok {
+			proc = keywordFunc(proc)
+		}
+		if !isFunc(proc) {
+			return fail(errorAt(newError(TypeError, "not a function: %s", exprToString(expr.expressions[0])), expr.pos))
+		}
+		var args []*expression
+		for _, subj := range expr.expressions[1:] {
+			arg, err := evalAt(env, subj, depth+1)
+			if err != nil {
+				return fail(err)
+			}
+			args = append(args, arg)
+		}
+		// fmt.Println("proc", exprToString(&proc))
+		// fmt.Println("proc args", exprToString(&expression{
+		// 	expressions: args,
+		// }))
+		name := exprToString(expr.expressions[0])
+		if proc.closure == nil {
+			// a builtin that calls back into tipi, like apply, nests its calls
+			// in the depth of the frame it is given
+			callEnv := env
+			if env.depth < depth-1 {
+				callEnv = &environment{parent: env, depth: depth - 1}
+			}
+			result, err := proc.gofunc(callEnv, args)
+			if err != nil {
+				return fail(callError(err, name, expr.pos))
+			}
+			return result, nil
+		}
+
+		if ctx := env.context(); ctx != nil && ctx.Err() != nil {
+			return fail(errorAt(ctx.Err(), expr.pos))
+		}
+
+		// a tail call, the new frame replaces the current one
+		callEnv, err := proc.closure.bind(args, depth)
+		if err != nil {
+			return fail(callError(err, name, expr.pos))
+		}
+		call = &Frame{Name: name, Pos: expr.pos}
+		env, expr = callEnv, proc.closure.body
+	}
+}
+
+// checkForm returns a syntax error unless the special form expr has between
+// min and max elements, including the form name itself.
+func checkForm(expr *expression, min, max int) error {
+	if n := len(expr.expressions); n < min || n > max {
+		name := *expr.expressions[0].atom.symbol
+		return errorAt(newError(SyntaxError, "%s: malformed form: %s", name, exprToString(expr)), expr.pos)
+	}
+	return nil
+}
+
+// closure is a function created by the func special form. params is either
+// a single symbol bound to the list of all arguments, or a list of symbols.
+type closure struct {
+	params   *expression
+	variadic bool
+	body     *expression
+	env      *environment
+}
+
+// maxDepth limits how deeply evaluation may nest, so that runaway recursion
+// fails with an error rather than exhausting the Go stack. Each level is an
+// evalAt frame, about 2KB, plus the frames of any Go code between it and the
+// next level, such as apply, try or a callback through reflect, the deepest
+// path. At this depth that path uses under 128MB of the default 1GB Go stack
+// limit, TestDeepRecursion runs each path into the limit.
+const maxDepth = 25000
+
+// bind returns the environment the body of c runs in, depth levels deep.
+func (c *closure) bind(args []*expression, depth int) (*environment, error) {
+	env := &environment{
+		parent: c.env,
+		values: map[string]*expression{},
+		depth:  depth,
+	}
+
+	if c.variadic {
+		env.values[*c.params.atom.symbol] = &expression{
+			expressions: args,
+		}
+		return env, nil
+	}
+
+	names := elements(c.params)
+	if len(args) != len(names) {
+		return nil, newError(ArityError, "wrong number of arguments: want %d, got %d", len(names), len(args))
+	}
+	for i, p := range names {
+		env.values[*p.atom.symbol] = args[i]
+	}
+	return env, nil
+}
+
+// makeFunc evaluates (func params body), closing over env.
+func makeFunc(env *environment, expr *expression) (*expression, error) {
+	params := expr.expressions[1]
+
+	variadic := params.atom != nil && params.atom.symbol != nil
+	if !variadic {
+		if params.atom != nil || isFunc(params) {
+			return nil, errorAt(newError(SyntaxError, "func: bad parameter list: %s", exprToString(params)), expr.pos)
+		}
+		for _, p := range elements(params) {
+			if _, err := symbolArg("func", p); err != nil {
+				return nil, errorAt(err, expr.pos)
+			}
+		}
+	}
+
+	return &expression{
+		closure: &closure{
+			params:   params,
+			variadic: variadic,
+			body:     expr.expressions[2],
+			env:      env,
+		},
+	}, nil
+}
+
+func isFunc(expr *expression) bool {
+	return expr != nil && (expr.gofunc != nil || expr.closure != nil)
+}
+
+// apply calls a builtin, Go function or closure with evaluated arguments.
+func apply(env *environment, proc *expression, args []*expression) (*expression, error) {
+	if _, ok := keywordName(proc); ok {
+		proc = keywordFunc(proc)
+	}
+	if proc.closure != nil {
+		if env.depth >= maxDepth {
+			return nil, newError(RuntimeError, "stack overflow: evaluation nested more than %d deep", maxDepth)
+		}
+		callEnv, err := proc.closure.bind(args, env.depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return eval(callEnv, proc.closure.body)
+	}
+	return proc.gofunc(env, args)
+}
+
+// quasiquote returns tmpl with every (unquote x) replaced by the value of x and
+// every (unquote-splicing x) replaced by the elements of x. Symbols ending in #
+// are replaced by a gensym, the same one for each occurrence in a template.
+//
+// depth is the nesting level of quasiquote forms. An unquote inside a nested
+// quasiquote belongs to it, it is only evaluated at depth 1.
+func quasiquote(env *environment, tmpl *expression, gensyms map[string]*expression, depth int) (*expression, error) {
+	if tmpl.atom != nil {
+		if s := tmpl.atom.symbol; s != nil && len(*s) > 1 && strings.HasSuffix(*s, "#") {
+			if gensyms[*s] == nil {
+				gensyms[*s] = gensym(strings.TrimSuffix(*s, "#"))
+			}
+			return gensyms[*s], nil
+		}
+		return tmpl, nil
+	}
+
+	if tmpl.hashMap != nil || tmpl.set != nil {
+		return walkColl(tmpl, func(e *expression) (*expression, error) {
+			return quasiquote(env, e, gensyms, depth)
+		})
+	}
+
+	if !isSeq(tmpl) {
+		return tmpl, nil
+	}
+
+	level, err := quasiLevel(tmpl, depth)
+	if err != nil {
+		return nil, err
+	}
+	if isForm(tmpl, "unquote-splicing") && level == 0 {
+		return nil, errorAt(newError(SyntaxError, "unquote-splicing: not inside a list: %s", exprToString(tmpl)), tmpl.pos)
+	}
+	if level == 0 {
+		return eval(env, tmpl.expressions[1])
+	}
+	if level != depth {
+		// an unquote or quasiquote kept for a nested template
+		q, err := quasiquote(env, tmpl.expressions[1], gensyms, level)
+		if err != nil {
+			return nil, err
+		}
+		return &expression{expressions: []*expression{tmpl.expressions[0], q}, pos: tmpl.pos}, nil
+	}
+
+	var elems []*expression
+	for _, e := range elements(tmpl) {
+		if level, err := quasiLevel(e, depth); err != nil {
+			return nil, err
+		} else if level == 0 && isForm(e, "unquote-splicing") {
+			spliced, err := eval(env, e.expressions[1])
+			if err != nil {
+				return nil, err
+			}
+			if spliced != nil {
+				splicedElems, err := seqArg("unquote-splicing", spliced)
+				if err != nil {
+					return nil, errorAt(err, e.pos)
+				}
+				elems = append(elems, splicedElems...)
+			}
+			continue
+		}
+		q, err := quasiquote(env, e, gensyms, depth)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, q)
+	}
+
+	if tmpl.vector != nil {
+		return &expression{vector: newVector(elems)}, nil
+	}
+	return &expression{expressions: elems}, nil
+}
+
+var gensymCounter int64
+
+// gensym returns a fresh symbol, used by macros to avoid capturing user
+// variables.
+func gensym(prefix string) *expression {
+	name := fmt.Sprintf("%s__%d__auto__", prefix, atomic.AddInt64(&gensymCounter, 1))
+	return &expression{
+		atom: &atom{symbol: &name},
+	}
+}
+
+// isForm reports whether expr is a list starting with the symbol name.
+func isForm(expr *expression, name string) bool {
+	if expr == nil || len(expr.expressions) == 0 {
+		return false
+	}
+	actorAtom := expr.expressions[0].atom
+	return actorAtom != nil && actorAtom.symbol != nil && *actorAtom.symbol == name
+}
+
+// quasiLevel returns the quasiquote depth that applies inside tmpl, a form
+// found at depth: one more inside a nested quasiquote, one less inside an
+// unquote or unquote-splicing. 0 means the form is evaluated. Other forms are
+// at depth.
+func quasiLevel(tmpl *expression, depth int) (int, error) {
+	change := 0
+	switch {
+	case isForm(tmpl, "quasiquote"):
+		change = 1
+	case isForm(tmpl, "unquote"), isForm(tmpl, "unquote-splicing"):
+		change = -1
+	default:
+		return depth, nil
+	}
+	if err := checkForm(tmpl, 2, 2); err != nil {
+		return 0, err
+	}
+	return depth + change, nil
+}
+
+// expandQuasi expands macros in the unquoted parts of a quasiquote template,
+// the ones evaluated by a template at the given depth.
+func expandQuasi(env *environment, tmpl *expression, depth int) (*expression, error) {
+	if tmpl != nil && (tmpl.hashMap != nil || tmpl.set != nil) {
+		return walkColl(tmpl, func(e *expression) (*expression, error) {
+			return expandQuasi(env, e, depth)
+		})
+	}
+
+	if !isSeq(tmpl) {
+		return tmpl, nil
+	}
+
+	level, err := quasiLevel(tmpl, depth)
+	if err != nil {
+		return nil, err
+	}
+	if level != depth {
+		var expanded *expression
+		if level == 0 {
+			expanded, err = expand(env, tmpl.expressions[1])
+		} else {
+			expanded, err = expandQuasi(env, tmpl.expressions[1], level)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &expression{
+			expressions: []*expression{tmpl.expressions[0], expanded},
+			pos:         tmpl.pos,
+		}, nil
+	}
+
+	var elems []*expression
+	for _, e := range elements(tmpl) {
+		expanded, err := expandQuasi(env, e, depth)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, expanded)
+	}
+	if tmpl.vector != nil {
+		return &expression{vector: newVector(elems), pos: tmpl.pos}, nil
+	}
+	return &expression{expressions: elems, pos: tmpl.pos}, nil
+}
+
+func expandAll(env *environment, exprs []*expression) ([]*expression, error) {
+	var result []*expression
+	for _, e := range exprs {
+		expanded, err := expand(env, e)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
+
+func expand(env *environment, expr *expression) (*expression, error) {
+	if expr != nil && (expr.hashMap != nil || expr.set != nil) {
+		return walkColl(expr, func(e *expression) (*expression, error) {
+			return expand(env, e)
+		})
+	}
+
+	if !isSeq(expr) {
+		return expr, nil
+	}
+
+	if expr.vector != nil {
+		elems, err := expandAll(env, expr.vector.slice())
+		if err != nil {
+			return nil, err
+		}
+		return &expression{vector: newVector(elems), pos: expr.pos}, nil
+	}
+
+	// a list built by a macro with cons or conj
+	if expr.list != nil {
+		expr = &expression{expressions: elements(expr), pos: expr.pos}
+	}
+
+	if len(expr.expressions) == 0 {
+		return expr, nil
+	}
+
+	var actor string
+	if actorAtom := expr.expressions[0].atom; actorAtom != nil && actorAtom.symbol != nil {
+		actor = *actorAtom.symbol
+	}
+
+	// if actorAtom != nil && actorAtom.symbol == nil {
+	// 	fmt.Println("expand nil", exprToString(expr))
+	// }
+	if actor == "quote" {
+		return expr, nil
+	}
+
+	if actor == "quasiquote" {
+		if err := checkForm(expr, 2, 2); err != nil {
+			return nil, err
+		}
+		tmpl, err := expandQuasi(env, expr.expressions[1], 1)
+		if err != nil {
+			return nil, err
+		}
+		return &expression{
+			expressions: []*expression{expr.expressions[0], tmpl},
+			pos:         expr.pos,
+		}, nil
+	}
+
+	if actor == "def" {
+		if err := checkForm(expr, 3, 3); err != nil {
+			return nil, err
+		}
+		expanded, err := expand(env, expr.expressions[2])
+		if err != nil {
+			return nil, err
+		}
+		expr.expressions[2] = expanded
+		return expr, nil
+	}
+
+	if actor == "func" {
+		if err := checkForm(expr, 3, 3); err != nil {
+			return nil, err
+		}
+		// parameters shadow macros of the same name in the body
+		scope := &environment{
+			parent: env,
+			values: map[string]*expression{},
+		}
+		params := expr.expressions[1]
+		if params.atom != nil && params.atom.symbol != nil {
+			scope.values[*params.atom.symbol] = nil
+		}
+		if params.atom == nil {
+			for _, p := range elements(params) {
+				if p.atom != nil && p.atom.symbol != nil {
+					scope.values[*p.atom.symbol] = nil
+				}
+			}
+		}
+		expanded, err := expand(scope, expr.expressions[2])
+		if err != nil {
+			return nil, err
+		}
+		expr.expressions[2] = expanded
+		return expr, nil
+	}
+
+	if actor == "def-macro" {
+		// (def-macro my-name (func ...)) defines the macro in the current
+		// scope, both for the rest of the expansion and at runtime for
+		// macro-expand
+		if err := checkForm(expr, 3, 3); err != nil {
+			return nil, err
+		}
+		name, err := symbolArg("def-macro", expr.expressions[1])
+		if err != nil {
+			return nil, errorAt(err, expr.pos)
+		}
+		expandedFunc, err := expand(env, expr.expressions[2])
+		if err != nil {
+			return nil, err
+		}
+		evaluatedFunc, err := eval(env, expandedFunc)
+		if err != nil {
+			return nil, err
+		}
+		if !isFunc(evaluatedFunc) {
+			return nil, errorAt(newError(TypeError, "def-macro: not a function: %s", exprToString(evaluatedFunc)), expr.pos)
+		}
+		env.defineMacro(name, evaluatedFunc)
+		return &expression{
+			expressions: []*expression{expr.expressions[0], expr.expressions[1], evaluatedFunc},
+			pos:         expr.pos,
+		}, nil
+	}
+
+	// calling a macro
+	if macro := env.lookupMacro(actor); actor != "" && macro != nil {
+		expanded, err := apply(env, macro, expr.expressions[1:])
+		if err != nil {
+			return nil, callError(err, actor, expr.pos)
+		}
+		return expand(env, expanded)
+	}
+
+	elems, err := expandAll(env, expr.expressions)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{
+		expressions: elems,
+		pos:         expr.pos,
+	}, nil
+}
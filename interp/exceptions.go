@@ -0,0 +1,80 @@
+package interp
+
+// evalTry evaluates (try body... (catch e handler...) (finally cleanup...)).
+// Both clauses are optional but must come last, in that order. The catch
+// clause binds e to the thrown value, or to an error value for runtime
+// errors and Go panics. The finally clause always runs, an error it raises
+// replaces the result of the try. The try is evaluated depth levels deep.
+func evalTry(env *environment, expr *expression, depth int) (result *expression, err error) {
+	body := expr.expressions[1:]
+	var catch, finally *expression
+	if n := len(body); n > 0 && isForm(body[n-1], "finally") {
+		finally, body = body[n-1], body[:n-1]
+	}
+	if n := len(body); n > 0 && isForm(body[n-1], "catch") {
+		catch, body = body[n-1], body[:n-1]
+	}
+
+	var name string
+	if catch != nil {
+		if len(catch.expressions) < 2 {
+			return nil, errorAt(newError(SyntaxError, "catch: malformed form: %s", exprToString(catch)), catch.pos)
+		}
+		if name, err = symbolArg("catch", catch.expressions[1]); err != nil {
+			return nil, errorAt(err, catch.pos)
+		}
+	}
+
+	if finally != nil {
+		defer func() {
+			if _, ferr := evalBody(env, finally.expressions[1:], depth); ferr != nil {
+				result, err = nil, ferr
+			}
+		}()
+	}
+
+	result, err = evalBody(env, body, depth)
+	if err == nil || catch == nil {
+		return result, err
+	}
+
+	catchEnv := &environment{
+		parent: env,
+		values: map[string]*expression{name: caught(err)},
+		depth:  depth,
+	}
+	return evalBody(catchEnv, catch.expressions[2:], depth)
+}
+
+// evalBody evaluates exprs in order, a level below depth, and returns the
+// last result. Go panics are returned as errors so they can be caught.
+func evalBody(env *environment, exprs []*expression, depth int) (result *expression, err error) {
+	defer recoverError(&err)
+
+	for _, e := range exprs {
+		if result, err = evalAt(env, e, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// caught returns the value a catch clause binds for err.
+func caught(err error) *expression {
+	e := errorAt(err, nil)
+	if e.thrown != nil {
+		return e.thrown
+	}
+	return &expression{err: e}
+}
+
+// throw returns the error raised by (throw v). Throwing a caught error value
+// rethrows a copy of the original error, the value itself is left as caught.
+func throw(v *expression) error {
+	if v != nil && v.err != nil {
+		return copyError(v.err)
+	}
+	e := newError(RuntimeError, "uncaught exception: %s", exprToString(v))
+	e.thrown = v
+	return e
+}
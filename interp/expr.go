@@ -0,0 +1,321 @@
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+func exprToString(expr *expression) string {
+	var b bytes.Buffer
+	writeExprToBuf(expr, &b)
+	return b.String()
+}
+
+func writeExprToBuf(expr *expression, buf *bytes.Buffer) {
+	if expr == nil {
+		buf.WriteString("nil")
+		return
+	}
+
+	if expr.atom != nil {
+		switch {
+		case expr.atom.boolean != nil:
+			buf.WriteString(fmt.Sprintf("%t", *expr.atom.boolean))
+		case isNumber(expr):
+			buf.WriteString(formatNumber(expr.atom))
+		case expr.atom.symbol != nil:
+			buf.WriteString(*expr.atom.symbol)
+		case expr.atom.keyword != nil:
+			buf.WriteString(":" + *expr.atom.keyword)
+		case expr.atom.char != nil:
+			buf.WriteString(formatChar(*expr.atom.char))
+		case expr.atom.str != nil:
+			buf.WriteString(fmt.Sprintf("%q", *expr.atom.str))
+		}
+
+		return
+	}
+
+	if expr.gofunc != nil {
+		buf.WriteString(fmt.Sprintf("gofunc-%p", expr.gofunc))
+		return
+	}
+
+	if expr.closure != nil {
+		buf.WriteString(fmt.Sprintf("func-%p", expr.closure))
+		return
+	}
+
+	if expr.err != nil {
+		buf.WriteString(fmt.Sprintf("(error %q)", expr.err.Msg))
+		return
+	}
+
+	if expr.handle != nil {
+		if expr.handle.v.Type() == chanType {
+			// made by chan or go
+			buf.WriteString(fmt.Sprintf("#chan<%v>", expr.handle.v))
+			return
+		}
+		buf.WriteString(fmt.Sprintf("#go<%v %v>", expr.handle.v.Type(), expr.handle.v))
+		return
+	}
+
+	if expr.hashMap != nil {
+		buf.WriteByte('{')
+		sep := ""
+		expr.hashMap.each(func(k, v *expression) {
+			buf.WriteString(sep)
+			writeExprToBuf(k, buf)
+			buf.WriteByte(' ')
+			writeExprToBuf(v, buf)
+			sep = " "
+		})
+		buf.WriteByte('}')
+		return
+	}
+
+	if expr.set != nil {
+		buf.WriteString("#{")
+		sep := ""
+		expr.set.each(func(k, _ *expression) {
+			buf.WriteString(sep)
+			writeExprToBuf(k, buf)
+			sep = " "
+		})
+		buf.WriteByte('}')
+		return
+	}
+
+	left, right := byte('('), byte(')')
+	if expr.vector != nil {
+		left, right = '[', ']'
+	}
+	elems := elements(expr)
+	buf.WriteByte(left)
+	for i, e := range elems {
+		writeExprToBuf(e, buf)
+		if i < len(elems)-1 {
+			buf.WriteByte(' ')
+		}
+	}
+	buf.WriteByte(right)
+}
+
+// formatChar formats r as a character literal the reader accepts.
+func formatChar(r rune) string {
+	for name, c := range charNames {
+		if c == r {
+			return `\` + name
+		}
+	}
+	switch {
+	case unicode.IsPrint(r):
+		return `\` + string(r)
+	case r > 0xffff:
+		return fmt.Sprintf(`\U%08x`, r)
+	}
+	return fmt.Sprintf(`\u%04x`, r)
+}
+
+func printAST(expr *expression, indent int) {
+	if expr.atom != nil {
+		fmt.Printf(strings.Repeat(" ", indent)+"atom: %+v\n", expr.atom)
+	}
+	if expr.expressions != nil {
+		for _, s := range expr.expressions {
+			printAST(s, indent+2)
+		}
+	}
+}
+
+// only one field will be non-nil
+type atom struct {
+	str      *string
+	integer  *int
+	bigint   *big.Int
+	rational *big.Rat
+	boolean  *bool
+	float    *float64
+	complex  *complex128
+	symbol   *string
+	keyword  *string // interned, equal keywords share the pointer
+	char     *rune
+}
+
+var keywords = struct {
+	sync.Mutex
+	names map[string]*string
+}{names: map[string]*string{}}
+
+// keywordAtom returns the keyword :name.
+func keywordAtom(name string) *atom {
+	keywords.Lock()
+	defer keywords.Unlock()
+	k, ok := keywords.names[name]
+	if !ok {
+		k = &name
+		keywords.names[name] = k
+	}
+	return &atom{keyword: k}
+}
+
+// keywordName returns the name of the keyword e, without the colon.
+func keywordName(e *expression) (string, bool) {
+	if e == nil || e.atom == nil || e.atom.keyword == nil {
+		return "", false
+	}
+	return *e.atom.keyword, true
+}
+
+// keywordFunc returns the function a keyword stands for when called, it
+// looks itself up in a map, as in (:name person) or (:name person default).
+func keywordFunc(k *expression) *expression {
+	return &expression{
+		gofunc: func(env *environment, args []*expression) (*expression, error) {
+			name := exprToString(k)
+			if err := checkArity(name, args, 1, 2); err != nil {
+				return nil, err
+			}
+			var notFound *expression
+			if len(args) == 2 {
+				notFound = args[1]
+			}
+			switch m := args[0]; {
+			case m == nil:
+			case m.hashMap != nil:
+				if v, ok := m.hashMap.get(k); ok {
+					return v, nil
+				}
+			case m.set != nil:
+				if m.set.contains(k) {
+					return k, nil
+				}
+			default:
+				return nil, newError(TypeError, "%s: not a map or set: %s", name, exprToString(m))
+			}
+			return notFound, nil
+		},
+	}
+}
+
+// only one field will be non-nil
+type expression struct {
+	expressions []*expression
+	atom        *atom
+	list        *list
+	vector      *vector
+	hashMap     *hashMap
+	set         *hashSet
+
+	// TODO neither an atom nor a list
+	gofunc  func(env *environment, args []*expression) (*expression, error)
+	closure *closure
+
+	// err is an error value, as bound by catch
+	err *Error
+
+	// handle is a Go value passed through from interop
+	handle *handle
+
+	// pos is where the expression was read, nil if it was built at runtime
+	pos *Position
+}
+
+// equal reports whether two values are structurally equal. Numbers are
+// compared by value across the numeric tower, lists and vectors element by
+// element and maps and sets by their entries. Functions and errors are equal only to
+// themselves.
+func equal(a, b *expression) bool {
+	switch {
+	case a == nil || b == nil:
+		return a == b
+	case isNumber(a) && isNumber(b):
+		cmp, ordered, err := compareNumbers("=", a.atom, b.atom)
+		return err == nil && ordered && cmp == 0
+	case a.atom != nil || b.atom != nil:
+		if a.atom == nil || b.atom == nil {
+			return false
+		}
+		x, y := a.atom, b.atom
+		switch {
+		case x.str != nil:
+			return y.str != nil && *x.str == *y.str
+		case x.symbol != nil:
+			return y.symbol != nil && *x.symbol == *y.symbol
+		case x.keyword != nil:
+			return x.keyword == y.keyword
+		case x.char != nil:
+			return y.char != nil && *x.char == *y.char
+		case x.boolean != nil:
+			return y.boolean != nil && *x.boolean == *y.boolean
+		}
+		return false
+	case a.hashMap != nil || b.hashMap != nil:
+		if a.hashMap == nil || b.hashMap == nil || a.hashMap.count != b.hashMap.count {
+			return false
+		}
+		eq := true
+		a.hashMap.each(func(k, v *expression) {
+			w, ok := b.hashMap.get(k)
+			eq = eq && ok && equal(v, w)
+		})
+		return eq
+	case a.set != nil || b.set != nil:
+		if a.set == nil || b.set == nil || a.set.count != b.set.count {
+			return false
+		}
+		eq := true
+		a.set.each(func(k, _ *expression) {
+			eq = eq && b.set.contains(k)
+		})
+		return eq
+	case a.handle != nil || b.handle != nil:
+		if a.handle == nil || b.handle == nil || !a.handle.v.Type().Comparable() {
+			return false
+		}
+		return a.handle.v.Type() == b.handle.v.Type() && a.handle.v.Interface() == b.handle.v.Interface()
+	case isFunc(a) || isFunc(b):
+		return a == b || (a.closure != nil && a.closure == b.closure)
+	case a.err != nil || b.err != nil:
+		return a.err == b.err
+	}
+	if seqLen(a) != seqLen(b) {
+		return false
+	}
+	x, y := elements(a), elements(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// elements returns the items of a list or a vector.
+func elements(expr *expression) []*expression {
+	switch {
+	case expr.vector != nil:
+		return expr.vector.slice()
+	case expr.list != nil:
+		elems := make([]*expression, 0, expr.list.count)
+		for ; expr.list != nil; expr = expr.list.rest {
+			elems = append(elems, expr.list.first)
+		}
+		return append(elems, expr.expressions...)
+	}
+	return expr.expressions
+}
+
+// isSeq reports whether expr is a list or a vector.
+func isSeq(expr *expression) bool {
+	return expr != nil && expr.atom == nil && !isFunc(expr) && expr.err == nil &&
+		expr.hashMap == nil && expr.set == nil && expr.handle == nil
+}
@@ -0,0 +1,513 @@
+package interp
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+)
+
+var (
+	bigIntType = reflect.TypeOf((*big.Int)(nil))
+	bigRatType = reflect.TypeOf((*big.Rat)(nil))
+	bytesType  = reflect.TypeOf([]byte(nil))
+
+	reflectTypeType = reflect.TypeOf((*reflect.Type)(nil)).Elem()
+)
+
+// handle is a Go value without a tipi equivalent, such as a struct, a
+// pointer or a channel. Tipi code can only pass it back to Go or read its
+// fields.
+type handle struct {
+	v reflect.Value
+}
+
+// goFunc wraps the Go function fn so it can be called from tipi. Arguments
+// are converted to the parameter types of fn, results back to tipi values.
+// A non-nil error result is raised, a nil one dropped. Multiple results are
+// returned as a list.
+func goFunc(name string, fn reflect.Value) *expression {
+	return &expression{
+		gofunc: func(env *environment, args []*expression) (*expression, error) {
+			return callGo(env, name, fn, args)
+		},
+	}
+}
+
+func callGo(env *environment, name string, fn reflect.Value, args []*expression) (result *expression, err error) {
+	// reflect panics on bad arguments, as do some Go functions
+	defer recoverError(&err)
+
+	call := &goCall{}
+	defer func() {
+		if cerr := call.finish(); cerr != nil && err == nil {
+			result, err = nil, cerr
+		}
+	}()
+
+	t := fn.Type()
+	if t.IsVariadic() {
+		if err := checkArity(name, args, t.NumIn()-1, -1); err != nil {
+			return nil, err
+		}
+	} else if err := checkArity(name, args, t.NumIn(), t.NumIn()); err != nil {
+		return nil, err
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= t.NumIn()-1 {
+			pt = t.In(t.NumIn() - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		if in[i], err = toReflect(env, call, a, pt); err != nil {
+			return nil, newError(TypeError, "%s: argument %d: %v", name, i+1, err)
+		}
+	}
+
+	var results []*expression
+	for i, r := range fn.Call(in) {
+		if t.Out(i) == errorType {
+			if r.IsNil() {
+				continue
+			}
+			// an error raised by a tipi callback comes back unchanged
+			if e, ok := r.Interface().(*Error); ok {
+				return nil, e
+			}
+			return nil, newError(RuntimeError, "%v", r.Interface())
+		}
+		results = append(results, fromReflect(r))
+	}
+
+	switch len(results) {
+	case 0:
+		return nil, nil
+	case 1:
+		return results[0], nil
+	}
+	return &expression{expressions: results}, nil
+}
+
+// goCall is a call from tipi into Go in progress. A tipi callback whose Go
+// func type has no error result keeps its error here, to be raised once the
+// call returns.
+type goCall struct {
+	mu   sync.Mutex
+	err  error
+	done bool
+}
+
+// fail keeps the first error raised by a callback of the call. Once the call
+// has returned, or outside of one, err is reported to the Interpreter
+// instead.
+func (c *goCall) fail(env *environment, err error) {
+	if c != nil {
+		c.mu.Lock()
+		kept := !c.done
+		if kept && c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+		if kept {
+			return
+		}
+	}
+	env.reportError(err)
+}
+
+// finish marks the call as returned and gives the error kept by fail.
+func (c *goCall) finish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	return c.err
+}
+
+// toReflect converts a tipi value to a Go value of type t. Callbacks made
+// from tipi functions raise their errors through call, nil if the value isn't
+// an argument of a call into Go.
+func toReflect(env *environment, call *goCall, expr *expression, t reflect.Type) (reflect.Value, error) {
+	mismatch := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %v", exprToString(expr), t)
+	}
+
+	if expr == nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), nil
+		}
+		return mismatch()
+	}
+
+	if expr.handle != nil {
+		v := expr.handle.v
+		switch {
+		case v.Type().AssignableTo(t):
+			return v, nil
+		case v.Type().ConvertibleTo(t):
+			return v.Convert(t), nil
+		}
+		return mismatch()
+	}
+
+	if t.Kind() == reflect.Interface {
+		g := toGo(expr)
+		if _, ok := g.(Value); ok {
+			return mismatch()
+		}
+		v := reflect.ValueOf(g)
+		if !v.Type().AssignableTo(t) {
+			return mismatch()
+		}
+		// keep the interface type, so the value can be stored in a slice or map
+		iv := reflect.New(t).Elem()
+		iv.Set(v)
+		return iv, nil
+	}
+
+	a := expr.atom
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		if a == nil || a.boolean == nil {
+			return mismatch()
+		}
+		v.SetBool(*a.boolean)
+	case reflect.String:
+		switch {
+		case a != nil && a.str != nil:
+			v.SetString(*a.str)
+		case a != nil && a.keyword != nil:
+			v.SetString(*a.keyword)
+		default:
+			return mismatch()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if a != nil && a.char != nil && t.Kind() == reflect.Int32 {
+			v.SetInt(int64(*a.char))
+			break
+		}
+		if a == nil || (a.integer == nil && a.bigint == nil) {
+			return mismatch()
+		}
+		b := toBig(a)
+		if !b.IsInt64() || v.OverflowInt(b.Int64()) {
+			return reflect.Value{}, fmt.Errorf("%s overflows %v", b, t)
+		}
+		v.SetInt(b.Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if a == nil || (a.integer == nil && a.bigint == nil) {
+			return mismatch()
+		}
+		b := toBig(a)
+		if !b.IsUint64() || v.OverflowUint(b.Uint64()) {
+			return reflect.Value{}, fmt.Errorf("%s overflows %v", b, t)
+		}
+		v.SetUint(b.Uint64())
+	case reflect.Float32, reflect.Float64:
+		if k, ok := numberKind(a); !ok || k == kindComplex {
+			return mismatch()
+		}
+		v.SetFloat(toFloat(a))
+	case reflect.Complex64, reflect.Complex128:
+		if !isNumber(expr) {
+			return mismatch()
+		}
+		v.SetComplex(toComplex(a))
+	case reflect.Ptr:
+		switch {
+		case t == bigIntType && a != nil && (a.integer != nil || a.bigint != nil):
+			return reflect.ValueOf(new(big.Int).Set(toBig(a))), nil
+		case t == bigRatType && a != nil && (a.integer != nil || a.bigint != nil || a.rational != nil):
+			return reflect.ValueOf(new(big.Rat).Set(toRat(a))), nil
+		}
+		return mismatch()
+	case reflect.Slice:
+		if t == bytesType && a != nil && a.str != nil {
+			return reflect.ValueOf([]byte(*a.str)), nil
+		}
+		if !isSeq(expr) {
+			return mismatch()
+		}
+		elems := elements(expr)
+		v = reflect.MakeSlice(t, len(elems), len(elems))
+		for i, e := range elems {
+			ev, err := toReflect(env, call, e, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(ev)
+		}
+	case reflect.Array:
+		if !isSeq(expr) {
+			return mismatch()
+		}
+		elems := elements(expr)
+		if len(elems) != t.Len() {
+			return reflect.Value{}, fmt.Errorf("cannot use %d elements as %v", len(elems), t)
+		}
+		for i, e := range elems {
+			ev, err := toReflect(env, call, e, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(ev)
+		}
+	case reflect.Func:
+		if !isFunc(expr) {
+			return mismatch()
+		}
+		return goCallback(env, call, expr, t), nil
+	case reflect.Map:
+		if expr.hashMap == nil {
+			return mismatch()
+		}
+		v = reflect.MakeMapWithSize(t, expr.hashMap.count)
+		var err error
+		expr.hashMap.each(func(k, x *expression) {
+			if err != nil {
+				return
+			}
+			var kv, xv reflect.Value
+			if kv, err = toReflect(env, call, k, t.Key()); err != nil {
+				return
+			}
+			if xv, err = toReflect(env, call, x, t.Elem()); err != nil {
+				return
+			}
+			v.SetMapIndex(kv, xv)
+		})
+		if err != nil {
+			return reflect.Value{}, err
+		}
+	default:
+		return mismatch()
+	}
+	return v, nil
+}
+
+// goCallback converts the tipi function proc to a Go func of type t.
+// Arguments are converted to tipi values, a variadic slice is spread, and
+// the result is converted to the result types of t. A func with several
+// results, not counting a trailing error, expects a list or vector from
+// proc. An error raised by proc is returned as the trailing error if t has
+// one. Otherwise the func returns zero values and the error is raised by
+// call, or reported to the Interpreter if Go calls the func after call has
+// returned, as from another goroutine.
+func goCallback(env *environment, call *goCall, proc *expression, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		n := t.NumOut()
+		hasErr := n > 0 && t.Out(n-1) == errorType
+		if hasErr {
+			n--
+		}
+		out := make([]reflect.Value, t.NumOut())
+		zero := func() {
+			for i := range out {
+				out[i] = reflect.Zero(t.Out(i))
+			}
+		}
+		zero()
+
+		// a panic here would kill the program if Go runs the func on a
+		// goroutine of its own, so it is returned like any other error
+		err := func() (err error) {
+			defer recoverError(&err)
+
+			var args []*expression
+			for i, v := range in {
+				if t.IsVariadic() && i == len(in)-1 {
+					for j := 0; j < v.Len(); j++ {
+						args = append(args, fromReflect(v.Index(j)))
+					}
+					break
+				}
+				args = append(args, fromReflect(v))
+			}
+			result, err := apply(env, proc, args)
+			if err != nil {
+				return err
+			}
+			return callbackResults(env, result, t, out[:n])
+		}()
+		if err != nil {
+			zero()
+			if !hasErr {
+				call.fail(env, err)
+				return out
+			}
+			out[n] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	})
+}
+
+// callbackResults converts the result of a tipi callback into out, the
+// results of Go func type t.
+func callbackResults(env *environment, result *expression, t reflect.Type, out []reflect.Value) error {
+	results := []*expression{result}
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+	default:
+		elems, err := seqArg("callback result", result)
+		if err != nil {
+			return err
+		}
+		if len(elems) != len(out) {
+			return newError(TypeError, "callback returned %d results, want %d", len(elems), len(out))
+		}
+		results = elems
+	}
+	for i := range out {
+		v, err := toReflect(env, nil, results[i], t.Out(i))
+		if err != nil {
+			return newError(TypeError, "callback result %d: %v", i+1, err)
+		}
+		out[i] = v
+	}
+	return nil
+}
+
+// fromReflect converts a Go value to a tipi value. Slices and arrays become
+// vectors, maps become maps and []byte a string. Values without a tipi
+// equivalent become handles.
+func fromReflect(v reflect.Value) *expression {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b := v.Bool()
+		return &expression{atom: &atom{boolean: &b}}
+	case reflect.String:
+		s := v.String()
+		return &expression{atom: &atom{str: &s}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &expression{atom: bigAtom(big.NewInt(v.Int()))}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &expression{atom: bigAtom(new(big.Int).SetUint64(v.Uint()))}
+	case reflect.Float32, reflect.Float64:
+		return &expression{atom: floatAtom(v.Float())}
+	case reflect.Complex64, reflect.Complex128:
+		return &expression{atom: complexAtom(v.Complex())}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return fromReflect(v.Elem())
+	case reflect.Ptr:
+		switch {
+		case v.IsNil():
+			return nil
+		case v.Type() == bigIntType:
+			return &expression{atom: bigAtom(new(big.Int).Set(v.Interface().(*big.Int)))}
+		case v.Type() == bigRatType:
+			return &expression{atom: ratAtom(new(big.Rat).Set(v.Interface().(*big.Rat)))}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type() == bytesType {
+			s := string(v.Bytes())
+			return &expression{atom: &atom{str: &s}}
+		}
+		elems := make([]*expression, v.Len())
+		for i := range elems {
+			elems[i] = fromReflect(v.Index(i))
+		}
+		return &expression{vector: newVector(elems)}
+	case reflect.Map:
+		m := &hashMap{}
+		iter := v.MapRange()
+		for iter.Next() {
+			m = m.assoc(fromReflect(iter.Key()), fromReflect(iter.Value()))
+		}
+		return &expression{hashMap: m}
+	}
+	return &expression{handle: &handle{v}}
+}
+
+// goType returns the Go type held by a handle, as looked up from a package
+// like strings.Builder.
+func goType(expr *expression) (reflect.Type, bool) {
+	if expr == nil || expr.handle == nil || !expr.handle.v.Type().Implements(reflectTypeType) {
+		return nil, false
+	}
+	t, ok := expr.handle.v.Interface().(reflect.Type)
+	return t, ok && t != nil
+}
+
+// methodFunc returns a function that calls the method name on the Go value
+// passed as its first argument, as in (.WriteString sb "x").
+func methodFunc(name string) *expression {
+	return &expression{
+		gofunc: func(env *environment, args []*expression) (*expression, error) {
+			if err := checkArity("."+name, args, 1, -1); err != nil {
+				return nil, err
+			}
+			if args[0] == nil || args[0].handle == nil {
+				return nil, newError(TypeError, ".%s: not a Go value: %s", name, exprToString(args[0]))
+			}
+			m := args[0].handle.method(name)
+			if !m.IsValid() {
+				return nil, newError(UnboundSymbolError, "%v has no method %s", args[0].handle.v.Type(), name)
+			}
+			return callGo(env, "."+name, m, args[1:])
+		},
+	}
+}
+
+// fieldFunc returns a function that reads the field name of the Go value
+// passed as its argument, as in (.-Name obj).
+func fieldFunc(name string) *expression {
+	return &expression{
+		gofunc: func(env *environment, args []*expression) (*expression, error) {
+			if err := checkArity(".-"+name, args, 1, 1); err != nil {
+				return nil, err
+			}
+			if args[0] == nil || args[0].handle == nil {
+				return nil, newError(TypeError, ".-%s: not a Go value: %s", name, exprToString(args[0]))
+			}
+			return args[0].handle.field(name)
+		},
+	}
+}
+
+// method returns the method name of the value held by h, or the zero Value
+// if there is none. Pointer methods of a value that isn't a pointer are
+// called on a copy.
+func (h *handle) method(name string) reflect.Value {
+	if m := h.v.MethodByName(name); m.IsValid() {
+		return m
+	}
+	if h.v.Kind() == reflect.Ptr || h.v.Kind() == reflect.Interface {
+		return reflect.Value{}
+	}
+	p := reflect.New(h.v.Type())
+	p.Elem().Set(h.v)
+	return p.MethodByName(name)
+}
+
+// field returns the exported field name of the struct held by h, following
+// pointers.
+func (h *handle) field(name string) (*expression, error) {
+	v := h.v
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, newError(RuntimeError, "field %s of nil %v", name, h.v.Type())
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, newError(TypeError, "%v is not a struct", h.v.Type())
+	}
+	f, ok := v.Type().FieldByName(name)
+	if !ok || f.PkgPath != "" {
+		return nil, newError(UnboundSymbolError, "%v has no exported field %s", v.Type(), name)
+	}
+	return fromReflect(v.FieldByIndex(f.Index)), nil
+}
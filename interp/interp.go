@@ -0,0 +1,426 @@
+// Package interp implements the tipi interpreter.
+package interp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"sync"
+
+	"github.com/robbiev/tipi/lexer"
+)
+
+// Interpreter evaluates tipi code. Definitions and macros made by one call
+// are visible to the next. An Interpreter is safe for use by multiple
+// goroutines. Calls are serialized, only one form is evaluated at a time, but
+// goroutines started with go run alongside and share its bindings.
+type Interpreter struct {
+	mu   sync.Mutex
+	root *environment // builtins
+	user *environment // the namespace code is evaluated in
+}
+
+// New returns an Interpreter with the builtins defined.
+func New() *Interpreter {
+	root := newBuiltins()
+	return &Interpreter{
+		root: root,
+		user: newNamespace(root, "user", "").env,
+	}
+}
+
+// GoFunc is a Go function that can be called from tipi. Arguments and the
+// result are converted as described for Value.Interface.
+type GoFunc func(args ...interface{}) (interface{}, error)
+
+// Define makes fn callable from tipi code as name. A panic in fn is returned
+// as an error of the call.
+func (in *Interpreter) Define(name string, fn GoFunc) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.root.define(name, &expression{
+		gofunc: func(env *environment, args []*expression) (result *expression, err error) {
+			defer recoverError(&err)
+
+			goArgs := make([]interface{}, len(args))
+			for i, a := range args {
+				goArgs[i] = toGo(a)
+			}
+			v, err := fn(goArgs...)
+			if err != nil {
+				return nil, err
+			}
+			return fromGo(v)
+		},
+	})
+}
+
+// HandleErrors sets the function given the errors that tipi code can't
+// catch: those raised by a tipi callback whose Go func type has no error
+// result, when Go calls it after the call it was passed to has returned, as
+// from a goroutine of its own. By default they are written to os.Stderr.
+func (in *Interpreter) HandleErrors(fn func(error)) {
+	in.root.mu.Lock()
+	defer in.root.mu.Unlock()
+	in.root.onError = fn
+}
+
+// Eval evaluates every form in src and returns the value of the last one,
+// converted as described for Value.Interface. Errors are positioned in a
+// source named <eval>.
+func (in *Interpreter) Eval(ctx context.Context, src string) (interface{}, error) {
+	r := NewReader("<eval>", src)
+	var result Value
+	for {
+		form, err := r.Read()
+		if err == io.EOF {
+			return result.Interface(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result, err = in.EvalForm(ctx, form); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Load reads and evaluates all of r.
+func (in *Interpreter) Load(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = in.Eval(context.Background(), string(b))
+	return err
+}
+
+// EvalForm macro expands and evaluates a form read by a Reader. Evaluation
+// stops with an error once ctx is done.
+func (in *Interpreter) EvalForm(ctx context.Context, form Value) (Value, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.root.setContext(ctx)
+	defer in.root.setContext(nil)
+
+	result, err := evalTop(in.user, form.expr)
+	return Value{result}, err
+}
+
+// evalTop expands and evaluates a top-level form. Go panics are returned as
+// errors.
+func evalTop(env *environment, expr *expression) (result *expression, err error) {
+	defer recoverError(&err)
+
+	expanded, err := expand(env, expr)
+	if err != nil {
+		return nil, err
+	}
+	return eval(env, expanded)
+}
+
+// Reader reads tipi source one top-level form at a time.
+type Reader struct {
+	name  string
+	in    io.Reader // nil once the input is drained
+	buf   []byte    // input read but not yet lexed into forms
+	tried int       // length of buf when it was last lexed
+	line  int       // lines preceding buf in the input
+	col   int       // bytes preceding buf on its first line
+	off   int       // bytes preceding buf in the input
+	cur   form      // the form the items lexed so far end in
+	depth int       // delimiters left open in cur
+	src   *source   // items are positioned from the start of the input
+	forms []form
+}
+
+// NewReader returns a Reader for src, name is used in error positions.
+func NewReader(name, src string) *Reader {
+	r := &Reader{name: name, buf: []byte(src), src: newSource(name, "")}
+	r.split(true)
+	return r
+}
+
+// NewStreamReader returns a Reader for the source read from in. A form is
+// returned as soon as it has been read in full, without waiting for the rest
+// of the input, so forms can be evaluated as they arrive.
+func NewStreamReader(name string, in io.Reader) *Reader {
+	return &Reader{name: name, in: in, src: newSource(name, "")}
+}
+
+// split lexes r.buf, adding the items to the form being read and moving the
+// complete forms to r.forms. Unless no more input follows, an atom, string or
+// error running up to the end of r.buf is left in it, more input could still
+// extend it. The rest of r.buf is dropped, so that the input is lexed about
+// once.
+func (r *Reader) split(final bool) {
+	l := lexer.New(r.name, string(r.buf))
+	end := 0
+	for {
+		item := l.Next()
+		if item.Type == lexer.ItemEOF {
+			if final {
+				end = len(r.buf)
+				if len(r.cur.items) > 0 || len(r.cur.errs) > 0 {
+					r.forms = append(r.forms, r.cur)
+					r.cur, r.depth = form{}, 0
+				}
+			}
+			break
+		}
+		if !final && int(l.Offset()) == len(r.buf) && !delimiters[item.Type] {
+			break
+		}
+		end = int(l.Offset())
+		r.add(r.locate(item))
+	}
+
+	done := r.buf[:end]
+	if i := bytes.LastIndexByte(done, '\n'); i >= 0 {
+		r.line += bytes.Count(done, []byte{'\n'})
+		r.col = len(done) - i - 1
+	} else {
+		r.col += len(done)
+	}
+	r.off += end
+	r.buf = append(r.buf[:0], r.buf[end:]...)
+	r.tried = len(r.buf)
+}
+
+// delimiters are the items that more input can't extend, ~ may be the start
+// of ~@.
+var delimiters = map[lexer.ItemType]bool{
+	lexer.ItemLeftParen:     true,
+	lexer.ItemRightParen:    true,
+	lexer.ItemLeftVect:      true,
+	lexer.ItemRightVect:     true,
+	lexer.ItemLeftBrace:     true,
+	lexer.ItemLeftSet:       true,
+	lexer.ItemRightBrace:    true,
+	lexer.ItemQuote:         true,
+	lexer.ItemQuasiQuote:    true,
+	lexer.ItemUnquoteSplice: true,
+}
+
+// locate positions item, lexed from r.buf, from the start of the input.
+func (r *Reader) locate(item lexer.Item) lexer.Item {
+	item.Pos += lexer.Pos(r.off)
+	if item.Line == 1 {
+		item.Col += r.col
+	}
+	item.Line += r.line
+	return item
+}
+
+// add appends item to the form being read, moving the form to r.forms once
+// it is complete.
+func (r *Reader) add(item lexer.Item) {
+	if item.Type == lexer.ItemError {
+		r.cur.errs = append(r.cur.errs, errorAt(newError(SyntaxError, "%s", item.Value), r.src.position(item)))
+	} else {
+		r.cur.items = append(r.cur.items, item)
+	}
+
+	switch item.Type {
+	case lexer.ItemLeftParen, lexer.ItemLeftVect, lexer.ItemLeftBrace, lexer.ItemLeftSet:
+		r.depth++
+		return
+	case lexer.ItemRightParen, lexer.ItemRightVect, lexer.ItemRightBrace:
+		// a stray closing delimiter is a form of its own, read rejects it
+		if r.depth--; r.depth > 0 {
+			return
+		}
+	case lexer.ItemQuote, lexer.ItemQuasiQuote, lexer.ItemUnquote, lexer.ItemUnquoteSplice:
+		// part of the form that follows
+		return
+	default:
+		if r.depth > 0 {
+			return
+		}
+	}
+	r.forms = append(r.forms, r.cur)
+	r.cur, r.depth = form{}, 0
+}
+
+// fill reads from r.in until a complete form has been read or the input
+// ends. While reads keep filling the whole buffer, more input is ready and
+// r.buf is only lexed again once it has doubled, so that an item spanning
+// many reads isn't lexed over and over.
+func (r *Reader) fill() error {
+	var p [4096]byte
+	for len(r.forms) == 0 && r.in != nil {
+		n, err := r.in.Read(p[:])
+		r.buf = append(r.buf, p[:n]...)
+		if err != nil {
+			r.in = nil
+			if err != io.EOF {
+				return err
+			}
+		}
+		if r.in == nil || n > 0 && (n < len(p) || len(r.buf) >= 2*r.tried) {
+			r.split(r.in == nil)
+		}
+	}
+	return nil
+}
+
+// Read returns the next form, or io.EOF when there are none left. A form
+// with lexical errors in it is returned as those errors, as an ErrorList when
+// there are several, and Read carries on with the forms that follow.
+func (r *Reader) Read() (Value, error) {
+	for len(r.forms) == 0 {
+		if r.in == nil {
+			return Value{}, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return Value{}, err
+		}
+	}
+	f := r.forms[0]
+	r.forms = r.forms[1:]
+	if len(f.errs) > 0 {
+		return Value{}, f.errs.err()
+	}
+	expr, _, err := read(r.src, f.items)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{expr}, nil
+}
+
+// Value is a tipi value. The zero Value is nil.
+type Value struct {
+	expr *expression
+}
+
+// String formats v as tipi source.
+func (v Value) String() string {
+	return exprToString(v.expr)
+}
+
+// Interface converts v to a Go value. Integers become int or *big.Int,
+// rationals *big.Rat, floats float64, complex numbers complex128, strings,
+// symbols and keywords string, characters rune, booleans bool, lists and vectors
+// []interface{}, maps map[interface{}]interface{}, sets map[interface{}]bool
+// and error values error. Go values passed through from interop are returned
+// as they were. Values without a Go equivalent, such as functions, are
+// returned as a Value.
+func (v Value) Interface() interface{} {
+	return toGo(v.expr)
+}
+
+func toGo(expr *expression) interface{} {
+	switch {
+	case expr == nil:
+		return nil
+	case expr.atom != nil:
+		a := expr.atom
+		switch {
+		case a.str != nil:
+			return *a.str
+		case a.symbol != nil:
+			return *a.symbol
+		case a.keyword != nil:
+			return *a.keyword
+		case a.char != nil:
+			return *a.char
+		case a.boolean != nil:
+			return *a.boolean
+		case a.integer != nil:
+			return *a.integer
+		case a.bigint != nil:
+			return a.bigint
+		case a.rational != nil:
+			return a.rational
+		case a.float != nil:
+			return *a.float
+		case a.complex != nil:
+			return *a.complex
+		}
+	case expr.err != nil:
+		return expr.err
+	case isFunc(expr):
+		return Value{expr}
+	case expr.handle != nil:
+		return expr.handle.v.Interface()
+	case expr.hashMap != nil:
+		m := make(map[interface{}]interface{}, expr.hashMap.count)
+		hashable := true
+		expr.hashMap.each(func(k, v *expression) {
+			gk := toGo(k)
+			if gk != nil && !reflect.TypeOf(gk).Comparable() {
+				hashable = false
+				return
+			}
+			m[gk] = toGo(v)
+		})
+		if !hashable {
+			return Value{expr}
+		}
+		return m
+	case expr.set != nil:
+		m := make(map[interface{}]bool, expr.set.count)
+		hashable := true
+		expr.set.each(func(k, _ *expression) {
+			gk := toGo(k)
+			if gk != nil && !reflect.TypeOf(gk).Comparable() {
+				hashable = false
+				return
+			}
+			m[gk] = true
+		})
+		if !hashable {
+			return Value{expr}
+		}
+		return m
+	}
+
+	elems := elements(expr)
+	result := make([]interface{}, len(elems))
+	for i, e := range elems {
+		result[i] = toGo(e)
+	}
+	return result
+}
+
+func fromGo(v interface{}) (*expression, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case Value:
+		return v.expr, nil
+	case bool:
+		return &expression{atom: &atom{boolean: &v}}, nil
+	case string:
+		return &expression{atom: &atom{str: &v}}, nil
+	case int:
+		return &expression{atom: intAtom(v)}, nil
+	case int64:
+		return &expression{atom: bigAtom(big.NewInt(v))}, nil
+	case *big.Int:
+		return &expression{atom: bigAtom(v)}, nil
+	case *big.Rat:
+		return &expression{atom: ratAtom(v)}, nil
+	case float64:
+		return &expression{atom: floatAtom(v)}, nil
+	case complex128:
+		return &expression{atom: complexAtom(v)}, nil
+	case error:
+		return &expression{err: errorAt(v, nil)}, nil
+	case []interface{}:
+		elems := make([]*expression, len(v))
+		for i, e := range v {
+			var err error
+			if elems[i], err = fromGo(e); err != nil {
+				return nil, err
+			}
+		}
+		return &expression{expressions: elems}, nil
+	}
+	return fromReflect(reflect.ValueOf(v)), nil
+}
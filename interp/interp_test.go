@@ -0,0 +1,265 @@
+package interp
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"neugram.io/ng/eval/gowrap"
+)
+
+func TestEvalInterface(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"(+ 1 2)", 3},
+		{"99999999999999999999", func() interface{} {
+			b, _ := new(big.Int).SetString("99999999999999999999", 10)
+			return b
+		}()},
+		{"(/ 1 2)", big.NewRat(1, 2)},
+		{"1.5", 1.5},
+		{"1+2i", complex(1, 2)},
+		{`"s"`, "s"},
+		{"'sym", "sym"},
+		{":kw", "kw"},
+		{`\a`, 'a'},
+		{"true", true},
+		{"'()", []interface{}{}},
+		{"[1 \"a\" [2]]", []interface{}{1, "a", []interface{}{2}}},
+		{"{:a 1}", map[interface{}]interface{}{"a": 1}},
+		{"#{1 2}", map[interface{}]bool{1: true, 2: true}},
+		{"(def x 1) (set! x 2) x", 2},
+		{"(= ##NaN 5)", false},
+		{"(<= ##NaN 1)", false},
+		{"(>= 1 ##NaN)", false},
+		{"(contains? #{##NaN} ##NaN)", false},
+	}
+	for _, test := range tests {
+		got, err := New().Eval(context.Background(), test.src)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestEvalErrorValue(t *testing.T) {
+	got, err := New().Eval(context.Background(), `(try (+ 1 "a") (catch e e))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := got.(error)
+	if !ok || !strings.Contains(e.Error(), "<eval>:1:6") {
+		t.Errorf("Eval gave %#v, want the positioned error value", got)
+	}
+}
+
+func TestRethrowLeavesCaughtError(t *testing.T) {
+	in := New()
+	_, err := in.Eval(context.Background(), `
+(def e1 (try (+ 1 "a") (catch e e)))
+(def rethrow (func () (throw e1)))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stack := func(src string) []Frame {
+		t.Helper()
+		_, err := in.Eval(context.Background(), src)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: error = %v, want an *Error", src, err)
+		}
+		return e.Stack
+	}
+
+	first := stack("(rethrow)")
+	for i := 0; i < 3; i++ {
+		if _, err := in.Eval(context.Background(), "(try (rethrow) (catch e e))"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if again := stack("(rethrow)"); !reflect.DeepEqual(again, first) {
+		t.Errorf("rethrown after being caught 3 times, stack = %v, want %v", again, first)
+	}
+	e1, _ := in.Eval(context.Background(), "e1")
+	if n := len(e1.(*Error).Stack); n != 1 {
+		t.Errorf("e1 has %d stack frames, want the 1 of (+ 1 \"a\")", n)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind ErrorKind
+		want string
+	}{
+		{"(+ 1\n  (nope))", UnboundSymbolError, "<eval>:2:4: unbound symbol: nope"},
+		{"(+ 1 @)", SyntaxError, "<eval>:1:6: unexpected character '@'"},
+		{`(+ 1 "a")`, TypeError, "<eval>:1:1: "},
+	}
+	for _, test := range tests {
+		_, err := New().Eval(context.Background(), test.src)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("Eval(%q) error = %v, want an *Error", test.src, err)
+			continue
+		}
+		if e.Kind != test.kind || !strings.HasPrefix(e.Error(), test.want) {
+			t.Errorf("Eval(%q) error = %v (kind %d), want %q (kind %d)", test.src, e, e.Kind, test.want, test.kind)
+		}
+	}
+}
+
+func TestDefine(t *testing.T) {
+	in := New()
+	in.Define("go-add", func(args ...interface{}) (interface{}, error) {
+		sum := 0
+		for _, a := range args {
+			sum += a.(int)
+		}
+		return sum, nil
+	})
+	in.Define("go-fail", func(args ...interface{}) (interface{}, error) {
+		return nil, errors.New("failed in Go")
+	})
+	in.Define("go-panic", func(args ...interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	in.Define("go-list", func(args ...interface{}) (interface{}, error) {
+		return []interface{}{args[0], "x"}, nil
+	})
+
+	got, err := in.Eval(context.Background(), "(go-add 1 2 (go-add 3 4))")
+	if err != nil || got != 10 {
+		t.Errorf("go-add = %v, %v, want 10", got, err)
+	}
+	got, err = in.Eval(context.Background(), "(first (go-list :k))")
+	if err != nil || got != "k" {
+		t.Errorf("go-list = %v, %v, want k", got, err)
+	}
+	got, err = in.Eval(context.Background(), "(try (go-fail) (catch e (error-message e)))")
+	if err != nil || got != "failed in Go" {
+		t.Errorf("caught go-fail = %v, %v, want its message", got, err)
+	}
+
+	_, err = in.Eval(context.Background(), "(+ 1\n (go-panic))")
+	var e *Error
+	if !errors.As(err, &e) || e.Pos == nil || e.Pos.String() != "<eval>:2:2" || !strings.Contains(e.Msg, "boom") {
+		t.Errorf("go-panic error = %v, want boom at <eval>:2:2", err)
+	}
+	if e != nil && (len(e.Stack) == 0 || e.Stack[0].Name != "go-panic") {
+		t.Errorf("go-panic stack = %v, want the go-panic call", e.Stack)
+	}
+}
+
+func TestEvalCancel(t *testing.T) {
+	in := New()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := in.Eval(ctx, "(def spin (func (n) (spin (+ n 1))))\n(spin 0)")
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Eval = %v, want the deadline error", err)
+	}
+
+	// the interpreter is usable again with a fresh context
+	got, err := in.Eval(context.Background(), "(spin (quote x))")
+	if err == nil {
+		t.Errorf("spin with a symbol = %v, want a type error", got)
+	}
+	if got, err := in.Eval(context.Background(), "(+ 1 1)"); err != nil || got != 2 {
+		t.Errorf("Eval after a cancel = %v, %v, want 2", got, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	in := New()
+	if err := in.Load(strings.NewReader("(def twice (func (x) (* 2 x)))")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := in.Eval(context.Background(), "(twice 21)"); err != nil || got != 42 {
+		t.Errorf("twice = %v, %v, want 42", got, err)
+	}
+	if err := in.Load(strings.NewReader("(twice")); err == nil {
+		t.Error("Load of an unfinished form succeeded")
+	}
+}
+
+func TestCallbackErrors(t *testing.T) {
+	var later func()
+	gowrap.Pkgs["tm"] = &gowrap.Pkg{Exports: map[string]reflect.Value{
+		"Later": reflect.ValueOf(func(f func()) { later = f }),
+		"Each":  reflect.ValueOf(func(f func(int)) { f(1); f(2) }),
+	}}
+	defer delete(gowrap.Pkgs, "tm")
+
+	in := New()
+	errs := make(chan error, 1)
+	in.HandleErrors(func(err error) { errs <- err })
+
+	// raised by the call when Go runs the callback before returning
+	_, err := in.Eval(context.Background(), `(tm.Each (func (n) (throw n)))`)
+	if err == nil || !strings.Contains(err.Error(), "uncaught exception") {
+		t.Errorf("tm.Each error = %v, want the thrown exception", err)
+	}
+
+	// handed to the error handler when it runs after the call returned, here
+	// on a goroutine of its own that the panic of an uncaught error would kill
+	if _, err := in.Eval(context.Background(), `(tm.Later (func () (throw "boom")))`); err != nil {
+		t.Fatalf("tm.Later: %v", err)
+	}
+	go later()
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "<eval>:1:20: uncaught exception") {
+			t.Errorf("handled error = %v, want the uncaught exception", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the callback error never reached the handler")
+	}
+}
+
+func TestDeepRecursion(t *testing.T) {
+	gowrap.Pkgs["deep"] = &gowrap.Pkg{Exports: map[string]reflect.Value{
+		"Call": reflect.ValueOf(func(f func(int) int, n int) int { return f(n) }),
+	}}
+	defer delete(gowrap.Pkgs, "deep")
+
+	// each recurses through a different path of Go frames, all must fail
+	// with an error before the Go stack runs out
+	tests := []string{
+		`(def f (func (n) (+ 1 (f (- n 1)))))`,
+		`(def f (func (n) (if (= n 0) 0 (+ 1 (try (apply f [(- n 1)]) (finally 1))))))`,
+		`(def f (func (n) (+ 1 (deep.Call f (- n 1)))))`,
+		`(def f (func (n) (try (+ 1 (f (- n 1))) (catch e (throw e)))))`,
+		`(def f (func (n) (select (default (+ 1 (f (- n 1)))))))`,
+		"(def f (func (n) `(~(f (- n 1)))))",
+		`(def f (func (n) [(f (- n 1))]))`,
+	}
+	for _, def := range tests {
+		in := New()
+		if _, err := in.Eval(context.Background(), def); err != nil {
+			t.Fatalf("%s: %v", def, err)
+		}
+		_, err := in.Eval(context.Background(), "(f 1000000)")
+		if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+			t.Errorf("%s: error = %.200v, want a stack overflow", def, err)
+		}
+	}
+
+	// recursion within the limit still works
+	in := New()
+	got, err := in.Eval(context.Background(), `(def f (func (n) (if (= n 0) 0 (+ 1 (f (- n 1)))))) (f 20000)`)
+	if err != nil || got != 20000 {
+		t.Errorf("(f 20000) = %v, %.200v, want 20000", got, err)
+	}
+}
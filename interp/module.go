@@ -0,0 +1,281 @@
+package interp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// namespace is the environment a .tp file is evaluated in. The definitions
+// of a required namespace are reached through its alias, as in alias.name.
+type namespace struct {
+	name   string
+	path   string // absolute path of the file, empty for stdin
+	env    *environment
+	loader *namespace // the namespace whose require loaded this one
+}
+
+// modules caches the namespaces loaded by require, keyed by absolute path.
+type modules struct {
+	mu      sync.Mutex
+	loaded  map[string]*namespace
+	loading map[string]*loadState
+}
+
+// loadState is a load in progress, done is closed once it has finished.
+// waiting is the path its loader is blocked on, a load in progress in
+// another goroutine, used to detect cycles between concurrent requires.
+type loadState struct {
+	done    chan struct{}
+	ns      *namespace
+	err     error
+	waiting string
+}
+
+func newNamespace(root *environment, name, path string) *namespace {
+	ns := &namespace{name: name, path: path}
+	ns.env = &environment{
+		parent: root,
+		values: map[string]*expression{},
+		ns:     ns,
+	}
+	return ns
+}
+
+// namespace returns the namespace e belongs to.
+func (e *environment) namespace() *namespace {
+	for ; e != nil; e = e.parent {
+		if e.ns != nil {
+			return e.ns
+		}
+	}
+	return nil
+}
+
+// global returns the namespace-level frame of e, where def binds names. Code
+// outside any namespace binds in the root environment.
+func (e *environment) global() *environment {
+	for ; e.parent != nil; e = e.parent {
+		if e.ns != nil {
+			return e
+		}
+	}
+	return e
+}
+
+func (e *environment) root() *environment {
+	for e.parent != nil {
+		e = e.parent
+	}
+	return e
+}
+
+// lookupAlias returns the namespace required as alias.
+func (e *environment) lookupAlias(alias string) *namespace {
+	for ; e != nil; e = e.parent {
+		e.mu.RLock()
+		ns, ok := e.aliases[alias]
+		e.mu.RUnlock()
+		if ok {
+			return ns
+		}
+	}
+	return nil
+}
+
+// evalRequire evaluates (require "path" :as alias) and
+// (require "path" :refer :all). Only the path is evaluated. The alias defaults
+// to the name given by the required file's ns form, or its base name.
+func evalRequire(env *environment, expr *expression, depth int) (*expression, error) {
+	if err := checkForm(expr, 2, 6); err != nil {
+		return nil, err
+	}
+	pathExpr, err := evalAt(env, expr.expressions[1], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	path, err := strArg("require", pathExpr)
+	if err != nil {
+		return nil, errorAt(err, expr.pos)
+	}
+
+	var alias string
+	var referAll bool
+	args := expr.expressions
+	for i := 2; i < len(args); i += 2 {
+		opt, ok := keywordName(args[i])
+		if !ok {
+			return nil, errorAt(newError(SyntaxError, "require: not a keyword: %s", exprToString(args[i])), expr.pos)
+		}
+		if i+1 == len(args) {
+			return nil, errorAt(newError(SyntaxError, "require: missing value for :%s", opt), expr.pos)
+		}
+		val := args[i+1]
+		switch all, _ := keywordName(val); {
+		case opt == "as":
+			if alias, err = symbolArg("require", val); err != nil {
+				return nil, errorAt(err, expr.pos)
+			}
+		case opt == "refer" && all == "all":
+			referAll = true
+		default:
+			return nil, errorAt(newError(SyntaxError, "require: unknown option :%s %s", opt, exprToString(val)), expr.pos)
+		}
+	}
+
+	// relative paths are resolved against the requiring file
+	if !filepath.IsAbs(path) {
+		if cur := env.namespace(); cur != nil && cur.path != "" {
+			path = filepath.Join(filepath.Dir(cur.path), path)
+		}
+	}
+	if filepath.Ext(path) == "" {
+		path += ".tp"
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, errorAt(err, expr.pos)
+	}
+
+	ns, err := load(env.root(), env.namespace(), path)
+	if err != nil {
+		return nil, callError(err, "require", expr.pos)
+	}
+
+	if referAll {
+		ns.env.mu.RLock()
+		for name, v := range ns.env.values {
+			env.define(name, v)
+		}
+		for name, m := range ns.env.macros {
+			env.defineMacro(name, m)
+		}
+		ns.env.mu.RUnlock()
+	}
+	if alias == "" && !referAll {
+		alias = ns.name
+	}
+	if alias != "" {
+		env.mu.Lock()
+		if env.aliases == nil {
+			env.aliases = map[string]*namespace{}
+		}
+		env.aliases[alias] = ns
+		env.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// load evaluates the file at path in a new namespace, once. from is the
+// namespace requiring it. A load already in progress in another goroutine is
+// waited for.
+func load(root *environment, from *namespace, path string) (*namespace, error) {
+	m := root.modules
+	m.mu.Lock()
+	if ns := m.loaded[path]; ns != nil {
+		m.mu.Unlock()
+		return ns, nil
+	}
+
+	// the requires in progress in this evaluation, outermost first
+	var chain []string
+	for ns := from; ns != nil && ns.path != ""; ns = ns.loader {
+		chain = append([]string{ns.path}, chain...)
+	}
+	if st := m.loading[path]; st != nil {
+		if cycle := m.cycle(chain, path); cycle != nil {
+			m.mu.Unlock()
+			return nil, newError(RuntimeError, "require: circular import: %s", strings.Join(cycle, " -> "))
+		}
+		// the load this evaluation is in, if it is still in progress
+		var own *loadState
+		if len(chain) > 0 {
+			own = m.loading[chain[len(chain)-1]]
+		}
+		if own != nil {
+			own.waiting = path
+		}
+		m.mu.Unlock()
+
+		<-st.done
+
+		if own != nil {
+			m.mu.Lock()
+			own.waiting = ""
+			m.mu.Unlock()
+		}
+		return st.ns, copyError(st.err)
+	}
+	st := &loadState{done: make(chan struct{})}
+	if m.loading == nil {
+		m.loading = map[string]*loadState{}
+	}
+	m.loading[path] = st
+	m.mu.Unlock()
+
+	st.ns, st.err = loadFile(root, from, path)
+
+	m.mu.Lock()
+	delete(m.loading, path)
+	if st.err == nil {
+		m.loaded[path] = st.ns
+	}
+	m.mu.Unlock()
+	close(st.done)
+	return st.ns, copyError(st.err)
+}
+
+// cycle returns the circular chain of requires that waiting for the load of
+// path would close, nil if there is none. Besides chain it follows the loads
+// other goroutines are blocked on. m.mu must be held.
+func (m *modules) cycle(chain []string, path string) []string {
+	cycle := append([]string{}, chain...)
+	for p := path; p != ""; {
+		cycle = append(cycle, p)
+		for i, c := range chain {
+			if c == p {
+				return cycle[i:]
+			}
+		}
+		st := m.loading[p]
+		if st == nil {
+			break
+		}
+		p = st.waiting
+	}
+	return nil
+}
+
+// loadFile reads and evaluates the file at path in a new namespace.
+func loadFile(root *environment, from *namespace, path string) (*namespace, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, newError(RuntimeError, "require: %v", err)
+	}
+
+	ns := newNamespace(root, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), path)
+	ns.loader = from
+	if err := evalSource(ns.env, newSource(path, string(b))); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// evalSource reads and evaluates every form in src.
+func evalSource(env *environment, src *source) error {
+	items, err := lexAll(src)
+	if err != nil {
+		return err
+	}
+	for len(items) > 0 {
+		var program *expression
+		var err error
+		if program, items, err = read(src, items); err != nil {
+			return err
+		}
+		if _, err := evalTop(env, program); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package interp
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// numKind orders the numeric tower from narrowest to widest. Arithmetic
+// promotes both operands to the wider kind, integer results that fit in an int
+// are narrowed back down.
+type numKind int
+
+const (
+	kindInt numKind = iota
+	kindBig
+	kindRat
+	kindFloat
+	kindComplex
+)
+
+func numberKind(a *atom) (numKind, bool) {
+	switch {
+	case a == nil:
+		return 0, false
+	case a.integer != nil:
+		return kindInt, true
+	case a.bigint != nil:
+		return kindBig, true
+	case a.rational != nil:
+		return kindRat, true
+	case a.float != nil:
+		return kindFloat, true
+	case a.complex != nil:
+		return kindComplex, true
+	}
+	return 0, false
+}
+
+func isNumber(expr *expression) bool {
+	if expr == nil {
+		return false
+	}
+	_, ok := numberKind(expr.atom)
+	return ok
+}
+
+// numberArgs returns a type error unless every argument is a number.
+func numberArgs(op string, args []*expression) error {
+	for _, a := range args {
+		if !isNumber(a) {
+			return newError(TypeError, "%s: not a number: %s", op, exprToString(a))
+		}
+	}
+	return nil
+}
+
+func intAtom(i int) *atom {
+	return &atom{integer: &i}
+}
+
+func bigAtom(b *big.Int) *atom {
+	if b.IsInt64() {
+		if i := b.Int64(); int64(int(i)) == i {
+			return intAtom(int(i))
+		}
+	}
+	return &atom{bigint: b}
+}
+
+func ratAtom(r *big.Rat) *atom {
+	if r.IsInt() {
+		return bigAtom(new(big.Int).Set(r.Num()))
+	}
+	return &atom{rational: r}
+}
+
+func floatAtom(f float64) *atom {
+	return &atom{float: &f}
+}
+
+func complexAtom(c complex128) *atom {
+	return &atom{complex: &c}
+}
+
+func toBig(a *atom) *big.Int {
+	if a.bigint != nil {
+		return a.bigint
+	}
+	return big.NewInt(int64(*a.integer))
+}
+
+func toRat(a *atom) *big.Rat {
+	switch {
+	case a.rational != nil:
+		return a.rational
+	case a.bigint != nil:
+		return new(big.Rat).SetInt(a.bigint)
+	}
+	return new(big.Rat).SetInt64(int64(*a.integer))
+}
+
+func toFloat(a *atom) float64 {
+	switch {
+	case a.float != nil:
+		return *a.float
+	case a.rational != nil:
+		f, _ := a.rational.Float64()
+		return f
+	case a.bigint != nil:
+		f, _ := new(big.Float).SetInt(a.bigint).Float64()
+		return f
+	}
+	return float64(*a.integer)
+}
+
+func toComplex(a *atom) complex128 {
+	if a.complex != nil {
+		return *a.complex
+	}
+	return complex(toFloat(a), 0)
+}
+
+func isZero(a *atom) bool {
+	switch {
+	case a.integer != nil:
+		return *a.integer == 0
+	case a.bigint != nil:
+		return a.bigint.Sign() == 0
+	case a.rational != nil:
+		return a.rational.Sign() == 0
+	case a.float != nil:
+		return *a.float == 0
+	}
+	return *a.complex == 0
+}
+
+// arith applies one of + - * / mod to two numbers.
+func arith(op string, x, y *atom) (*atom, error) {
+	kx, _ := numberKind(x)
+	ky, _ := numberKind(y)
+	k := kx
+	if ky > k {
+		k = ky
+	}
+
+	if (op == "/" || op == "mod") && k <= kindRat && isZero(y) {
+		return nil, newError(RuntimeError, "%s: divide by zero", op)
+	}
+	if op == "/" && k < kindRat {
+		// exact division, narrowed back to an integer when possible
+		k = kindRat
+	}
+
+	switch k {
+	case kindInt:
+		if r, ok := intArith(op, *x.integer, *y.integer); ok {
+			return intAtom(r), nil
+		}
+		return bigArith(op, toBig(x), toBig(y)), nil
+	case kindBig:
+		return bigArith(op, toBig(x), toBig(y)), nil
+	case kindRat:
+		return ratArith(op, toRat(x), toRat(y)), nil
+	case kindFloat:
+		a, b := toFloat(x), toFloat(y)
+		switch op {
+		case "+":
+			return floatAtom(a + b), nil
+		case "-":
+			return floatAtom(a - b), nil
+		case "*":
+			return floatAtom(a * b), nil
+		case "/":
+			return floatAtom(a / b), nil
+		}
+		m := math.Mod(a, b)
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return floatAtom(m), nil
+	}
+
+	a, b := toComplex(x), toComplex(y)
+	switch op {
+	case "+":
+		return complexAtom(a + b), nil
+	case "-":
+		return complexAtom(a - b), nil
+	case "*":
+		return complexAtom(a * b), nil
+	case "/":
+		return complexAtom(a / b), nil
+	}
+	return nil, newError(TypeError, "%s: not defined for complex numbers", op)
+}
+
+// intArith reports false when the result overflows an int.
+func intArith(op string, a, b int) (int, bool) {
+	switch op {
+	case "+":
+		r := a + b
+		return r, (r > a) == (b > 0)
+	case "-":
+		r := a - b
+		return r, (r < a) == (b > 0)
+	case "*":
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		r := a * b
+		return r, r/b == a && !(a == -1 && b == math.MinInt) && !(b == -1 && a == math.MinInt)
+	case "mod":
+		if b == -1 {
+			return 0, true
+		}
+		m := a % b
+		if m != 0 && (m < 0) != (b < 0) {
+			m += b
+		}
+		return m, true
+	}
+	panic("unknown operator " + op)
+}
+
+func bigArith(op string, a, b *big.Int) *atom {
+	r := new(big.Int)
+	switch op {
+	case "+":
+		r.Add(a, b)
+	case "-":
+		r.Sub(a, b)
+	case "*":
+		r.Mul(a, b)
+	case "mod":
+		r.Rem(a, b)
+		if r.Sign() != 0 && r.Sign() != b.Sign() {
+			r.Add(r, b)
+		}
+	default:
+		panic("unknown operator " + op)
+	}
+	return bigAtom(r)
+}
+
+func ratArith(op string, a, b *big.Rat) *atom {
+	r := new(big.Rat)
+	switch op {
+	case "+":
+		r.Add(a, b)
+	case "-":
+		r.Sub(a, b)
+	case "*":
+		r.Mul(a, b)
+	case "/":
+		r.Quo(a, b)
+	case "mod":
+		// a - b*floor(a/b), denominators are always positive
+		q := new(big.Rat).Quo(a, b)
+		floor := new(big.Int).Div(q.Num(), q.Denom())
+		r.Sub(a, new(big.Rat).Mul(b, new(big.Rat).SetInt(floor)))
+	}
+	return ratAtom(r)
+}
+
+// compareNumbers returns -1, 0 or 1, and ordered false if NaN is one of x and
+// y, making every comparison false. Complex numbers are only comparable for
+// equality.
+func compareNumbers(op string, x, y *atom) (cmp int, ordered bool, err error) {
+	kx, _ := numberKind(x)
+	ky, _ := numberKind(y)
+	k := kx
+	if ky > k {
+		k = ky
+	}
+
+	switch k {
+	case kindInt:
+		a, b := *x.integer, *y.integer
+		switch {
+		case a < b:
+			return -1, true, nil
+		case a > b:
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case kindBig:
+		return toBig(x).Cmp(toBig(y)), true, nil
+	case kindRat:
+		return toRat(x).Cmp(toRat(y)), true, nil
+	case kindFloat:
+		a, b := toFloat(x), toFloat(y)
+		switch {
+		case a < b:
+			return -1, true, nil
+		case a > b:
+			return 1, true, nil
+		case a == b:
+			return 0, true, nil
+		}
+		return 0, false, nil
+	}
+
+	if op == "=" {
+		// a NaN part makes them unequal
+		if toComplex(x) == toComplex(y) {
+			return 0, true, nil
+		}
+		return 1, true, nil
+	}
+	return 0, false, newError(TypeError, "%s: complex numbers are not ordered", op)
+}
+
+// arithFunc builds a variadic builtin for op. identity is the result with no
+// arguments, a single argument x is treated as (op identity x).
+func arithFunc(op string, identity int) func(env *environment, args []*expression) (*expression, error) {
+	return func(env *environment, args []*expression) (*expression, error) {
+		if err := numberArgs(op, args); err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return &expression{atom: intAtom(identity)}, nil
+		}
+
+		result := args[0].atom
+		rest := args[1:]
+		if len(args) == 1 && (op == "-" || op == "/") {
+			result, rest = intAtom(identity), args
+		}
+		for _, a := range rest {
+			var err error
+			if result, err = arith(op, result, a.atom); err != nil {
+				return nil, err
+			}
+		}
+		return &expression{atom: result}, nil
+	}
+}
+
+// compareFunc builds a builtin that checks ok holds for each adjacent pair of
+// arguments.
+func compareFunc(op string, ok func(cmp int) bool) func(env *environment, args []*expression) (*expression, error) {
+	return func(env *environment, args []*expression) (*expression, error) {
+		if err := checkArity(op, args, 1, -1); err != nil {
+			return nil, err
+		}
+		if err := numberArgs(op, args); err != nil {
+			return nil, err
+		}
+		result := true
+		for i := 1; i < len(args) && result; i++ {
+			cmp, ordered, err := compareNumbers(op, args[i-1].atom, args[i].atom)
+			if err != nil {
+				return nil, err
+			}
+			result = ordered && ok(cmp)
+		}
+		return &expression{atom: &atom{boolean: &result}}, nil
+	}
+}
+
+// formatNumber prints a number so the lexer reads it back as the same kind.
+// Infinities and NaN print as ##Inf, ##-Inf and ##NaN. Complex numbers with
+// such a part are the exception, they do not read back.
+func formatNumber(a *atom) string {
+	switch {
+	case a.integer != nil:
+		return strconv.Itoa(*a.integer)
+	case a.bigint != nil:
+		return a.bigint.String()
+	case a.rational != nil:
+		return a.rational.String()
+	case a.float != nil:
+		switch f := *a.float; {
+		case math.IsInf(f, 1):
+			return "##Inf"
+		case math.IsInf(f, -1):
+			return "##-Inf"
+		case math.IsNaN(f):
+			return "##NaN"
+		}
+		s := strconv.FormatFloat(*a.float, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	}
+	s := strconv.FormatComplex(*a.complex, 'g', -1, 128)
+	return s[1 : len(s)-1] // remove surrounding parens
+}
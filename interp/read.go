@@ -0,0 +1,343 @@
+package interp
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/robbiev/tipi/lexer"
+)
+
+// lexAll lexes src into a slice, the EOF item is dropped. Error items are
+// returned as an error listing every one of them.
+func lexAll(src *source) (items []lexer.Item, err error) {
+	l := lexer.New(src.name, src.text)
+	var errs ErrorList
+	for {
+		item := l.Next()
+		switch item.Type {
+		case lexer.ItemEOF:
+			return items, errs.err()
+		case lexer.ItemError:
+			errs = append(errs, errorAt(newError(SyntaxError, "%s", item.Value), src.position(item)))
+		default:
+			items = append(items, item)
+		}
+	}
+}
+
+// form holds the items of one top-level form, or the lexical errors found
+// in its place.
+type form struct {
+	items []lexer.Item
+	errs  ErrorList
+}
+
+var readerMacros = map[lexer.ItemType]string{
+	lexer.ItemQuote:         "quote",
+	lexer.ItemQuasiQuote:    "quasiquote",
+	lexer.ItemUnquote:       "unquote",
+	lexer.ItemUnquoteSplice: "unquote-splicing",
+}
+
+func read(src *source, tokens []lexer.Item) (*expression, []lexer.Item, error) {
+	if len(tokens) == 0 {
+		return nil, nil, newError(SyntaxError, "unexpected EOF")
+	}
+	token, poptokens := tokens[0], tokens[1:]
+	pos := src.position(token)
+	switch token.Type {
+	case lexer.ItemLeftParen:
+		exprs, poptokens, err := readSeq(src, poptokens, lexer.ItemRightParen)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		return &expression{expressions: exprs, pos: pos}, poptokens, nil
+	case lexer.ItemLeftVect:
+		exprs, poptokens, err := readSeq(src, poptokens, lexer.ItemRightVect)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		return &expression{vector: newVector(exprs), pos: pos}, poptokens, nil
+	case lexer.ItemLeftBrace:
+		exprs, poptokens, err := readSeq(src, poptokens, lexer.ItemRightBrace)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		if len(exprs)%2 != 0 {
+			return nil, nil, errorAt(newError(SyntaxError, "map literal must contain an even number of forms"), pos)
+		}
+		m := &hashMap{}
+		for i := 0; i < len(exprs); i += 2 {
+			m = m.assoc(exprs[i], exprs[i+1])
+		}
+		if m.count != len(exprs)/2 {
+			return nil, nil, errorAt(newError(SyntaxError, "duplicate key in map literal"), pos)
+		}
+		return &expression{hashMap: m, pos: pos}, poptokens, nil
+	case lexer.ItemLeftSet:
+		exprs, poptokens, err := readSeq(src, poptokens, lexer.ItemRightBrace)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		set := &hashSet{}
+		for _, e := range exprs {
+			set = set.conj(e)
+		}
+		if set.count != len(exprs) {
+			return nil, nil, errorAt(newError(SyntaxError, "duplicate element in set literal"), pos)
+		}
+		return &expression{set: set, pos: pos}, poptokens, nil
+	case lexer.ItemQuote, lexer.ItemQuasiQuote, lexer.ItemUnquote, lexer.ItemUnquoteSplice:
+		// 'x reads as (quote x), `x as (quasiquote x) and so on
+		quoted, poptokens, err := read(src, poptokens)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		name := readerMacros[token.Type]
+		return &expression{
+			expressions: []*expression{{atom: &atom{symbol: &name}, pos: pos}, quoted},
+			pos:         pos,
+		}, poptokens, nil
+	case lexer.ItemRightParen:
+		return nil, nil, errorAt(newError(SyntaxError, "unexpected )"), pos)
+	case lexer.ItemRightVect:
+		return nil, nil, errorAt(newError(SyntaxError, "unexpected ]"), pos)
+	case lexer.ItemRightBrace:
+		return nil, nil, errorAt(newError(SyntaxError, "unexpected }"), pos)
+	default:
+		at, err := readAtom(token)
+		if err != nil {
+			return nil, nil, errorAt(err, pos)
+		}
+		return &expression{atom: at, pos: pos}, poptokens, nil
+	}
+}
+
+// readSeq reads expressions up to and including the closing token.
+func readSeq(src *source, tokens []lexer.Item, closing lexer.ItemType) ([]*expression, []lexer.Item, error) {
+	var exprs []*expression
+	for len(tokens) > 0 && tokens[0].Type != closing {
+		subast, ntokens, err := read(src, tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs = append(exprs, subast)
+		tokens = ntokens
+	}
+	if len(tokens) == 0 {
+		return nil, nil, newError(SyntaxError, "unexpected EOF, missing %v", closing)
+	}
+	return exprs, tokens[1:], nil // pop off the closing token
+}
+
+func readAtom(s lexer.Item) (*atom, error) {
+	switch s.Type {
+	case lexer.ItemString:
+		// remove surrounding double quotes
+		str, err := unescape(s.Value[1 : len(s.Value)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &atom{
+			str: &str,
+		}, nil
+	case lexer.ItemRawString:
+		str := s.Value[3 : len(s.Value)-3]
+		return &atom{
+			str: &str,
+		}, nil
+	case lexer.ItemChar:
+		r, err := readChar(s.Value[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &atom{
+			char: &r,
+		}, nil
+	case lexer.ItemInt:
+		i, err := strconv.ParseInt(s.Value, 0, strconv.IntSize)
+		if err == nil {
+			return intAtom(int(i)), nil
+		}
+		// too big for an int
+		b, ok := new(big.Int).SetString(s.Value, 0)
+		if !ok {
+			return nil, newError(SyntaxError, "bad integer: %s", s.Value)
+		}
+		return bigAtom(b), nil
+	case lexer.ItemRational:
+		// both parts are read like integers
+		i := strings.IndexByte(s.Value, '/')
+		num, ok := new(big.Int).SetString(s.Value[:i], 0)
+		den, dok := new(big.Int).SetString(s.Value[i+1:], 0)
+		if !ok || !dok || den.Sign() == 0 {
+			return nil, newError(SyntaxError, "bad rational: %s", s.Value)
+		}
+		return ratAtom(new(big.Rat).SetFrac(num, den)), nil
+	case lexer.ItemFloat:
+		// ##Inf, ##-Inf and ##NaN are the special floats
+		f, err := strconv.ParseFloat(strings.TrimPrefix(s.Value, "##"), 64)
+		if err != nil {
+			return nil, newError(SyntaxError, "bad float: %s", s.Value)
+		}
+		return floatAtom(f), nil
+	case lexer.ItemComplex:
+		c, ok := parseComplex(s.Value)
+		if !ok {
+			return nil, newError(SyntaxError, "bad complex number: %s", s.Value)
+		}
+		return complexAtom(c), nil
+	case lexer.ItemBool:
+		b := s.Value == "true"
+		return &atom{
+			boolean: &b,
+		}, nil
+	case lexer.ItemIdent:
+		return &atom{
+			symbol: &s.Value,
+		}, nil
+	case lexer.ItemKeyword:
+		return keywordAtom(s.Value[1:]), nil
+	}
+
+	return nil, newError(SyntaxError, "unexpected %v: %s", s.Type, s.Value)
+}
+
+// parseComplex parses a complex number like 1+2i or 0o17i. Either part may be
+// written in any base, as in Go.
+func parseComplex(s string) (complex128, bool) {
+	if c, err := strconv.ParseComplex(s, 128); err == nil {
+		return c, true
+	}
+	// ParseComplex takes decimal and hex floats only
+	re, im := "", s[:len(s)-1]
+	for i := len(im) - 1; i > 0; i-- {
+		if im[i] != '+' && im[i] != '-' {
+			continue
+		}
+		exponent := "eE"
+		if head := strings.TrimLeft(im[:i], "+-"); strings.HasPrefix(head, "0x") || strings.HasPrefix(head, "0X") {
+			exponent = "pP"
+		}
+		if !strings.ContainsRune(exponent, rune(im[i-1])) {
+			re, im = im[:i], im[i:]
+			break
+		}
+	}
+	r, ok := parseReal(re)
+	i, iok := parseReal(im)
+	return complex(r, i), ok && iok
+}
+
+// parseReal parses a float or an integer in any base, "" is 0.
+func parseReal(s string) (float64, bool) {
+	if s == "" {
+		return 0, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	b, ok := new(big.Int).SetString(s, 0)
+	if !ok {
+		return 0, false
+	}
+	f, _ := new(big.Float).SetInt(b).Float64()
+	return f, true
+}
+
+// escapes maps the single character escapes of string literals to what they
+// stand for.
+var escapes = map[byte]byte{
+	'a':  '\a',
+	'b':  '\b',
+	'f':  '\f',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'v':  '\v',
+	'\\': '\\',
+	'"':  '"',
+}
+
+// unescape decodes the escapes of a string literal, the ones Go uses: \n and
+// the like, \xNN for a byte, \uXXXX and \UXXXXXXXX for a code point.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", newError(SyntaxError, "unterminated escape in string")
+		}
+		if c, ok := escapes[s[i]]; ok {
+			b.WriteByte(c)
+			continue
+		}
+		var n int
+		switch s[i] {
+		case 'x':
+			n = 2
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			return "", newError(SyntaxError, "unknown escape in string: \\%c", s[i])
+		}
+		if i+n >= len(s) {
+			return "", newError(SyntaxError, "short escape in string: \\%s", s[i:])
+		}
+		v, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+		if err != nil {
+			return "", newError(SyntaxError, "bad escape in string: \\%s", s[i:i+1+n])
+		}
+		if s[i] == 'x' {
+			b.WriteByte(byte(v))
+		} else {
+			if !utf8.ValidRune(rune(v)) {
+				return "", newError(SyntaxError, "bad escape in string: \\%s", s[i:i+1+n])
+			}
+			b.WriteRune(rune(v))
+		}
+		i += n
+	}
+	return b.String(), nil
+}
+
+// charNames are the named character literals, as in \newline.
+var charNames = map[string]rune{
+	"newline":   '\n',
+	"space":     ' ',
+	"tab":       '\t',
+	"return":    '\r',
+	"backspace": '\b',
+	"formfeed":  '\f',
+}
+
+// readChar decodes the name of a character literal, the text after the
+// backslash: the character itself, a name like newline, or a code point as
+// uXXXX or UXXXXXXXX.
+func readChar(name string) (rune, error) {
+	if r, size := utf8.DecodeRuneInString(name); size == len(name) && r != utf8.RuneError {
+		return r, nil
+	}
+	if r, ok := charNames[name]; ok {
+		return r, nil
+	}
+	if (len(name) == 5 && name[0] == 'u') || (len(name) == 9 && name[0] == 'U') {
+		v, err := strconv.ParseUint(name[1:], 16, 32)
+		// surrogate halves are not characters
+		if err == nil && utf8.ValidRune(rune(v)) {
+			return rune(v), nil
+		}
+	}
+	return 0, newError(SyntaxError, "unknown character: \\%s", name)
+}
@@ -0,0 +1,181 @@
+package interp
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readWithin reads a form from r, failing the test if that takes longer than
+// a second, as it does when r waits for input that has not been written yet.
+func readWithin(t *testing.T, r *Reader) (Value, error) {
+	t.Helper()
+	type result struct {
+		v   Value
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := r.Read()
+		done <- result{v, err}
+	}()
+	select {
+	case res := <-done:
+		return res.v, res.err
+	case <-time.After(time.Second):
+		t.Fatal("Read blocked waiting for more input")
+		return Value{}, nil
+	}
+}
+
+func TestStreamReaderEvaluatesFormsAsTheyArrive(t *testing.T) {
+	pr, pw := io.Pipe()
+	writes := make(chan string, 16)
+	go func() {
+		for s := range writes {
+			pw.Write([]byte(s))
+		}
+		pw.Close()
+	}()
+
+	in := New()
+	r := NewStreamReader("pipe", pr)
+	eval := func(want string) {
+		t.Helper()
+		form, err := readWithin(t, r)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		v, err := in.EvalForm(context.Background(), form)
+		if err != nil {
+			t.Fatalf("EvalForm(%v): %v", form, err)
+		}
+		if got := v.String(); got != want {
+			t.Errorf("%v = %s, want %s", form, got, want)
+		}
+	}
+
+	// the complete form runs before the rest of the line is written
+	writes <- "(def a 1) (+ a"
+	eval("nil")
+	writes <- " 1)"
+	eval("2")
+	writes <- " [a\n"
+	writes <- " a] "
+	eval("[1 1]")
+
+	// an atom is only known to be complete once something follows it
+	writes <- "12"
+	writes <- "3 "
+	eval("123")
+
+	// forms before a lexical error run first, the error comes after them
+	writes <- "(def b a) @\n"
+	eval("nil")
+	if _, err := readWithin(t, r); err == nil || err.Error() != "pipe:2:19: unexpected character '@'" {
+		t.Errorf("Read error = %v, want the unexpected @ with its position", err)
+	}
+	writes <- "b\n"
+	eval("1")
+
+	close(writes)
+	if _, err := readWithin(t, r); err != io.EOF {
+		t.Errorf("Read at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderPositions(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, s := range []string{"(foo) (bar", "\n  baz) (qux", ")\n"} {
+			pw.Write([]byte(s))
+		}
+		pw.Close()
+	}()
+
+	r := NewStreamReader("pipe", pr)
+	var got []string
+	for {
+		form, err := readWithin(t, r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, form.expr.pos.String())
+	}
+	want := []string{"pipe:1:1", "pipe:1:7", "pipe:2:8"}
+	if len(got) != len(want) {
+		t.Fatalf("positions = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("form %d at %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReaderCarriesOnAfterErrors(t *testing.T) {
+	src := "(a) @ (b [c @ d]) (e)\n"
+	want := []string{
+		"(a)",
+		"pipe:1:5: unexpected character '@'",
+		"pipe:1:13: unexpected character '@'",
+		"(e)",
+	}
+	// the same forms and errors however the input is split into reads
+	for split := 0; split <= len(src); split++ {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, s := range []string{src[:split], src[split:]} {
+				if s != "" {
+					pw.Write([]byte(s))
+				}
+			}
+			pw.Close()
+		}()
+
+		r := NewStreamReader("pipe", pr)
+		var got []string
+		for {
+			form, err := readWithin(t, r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				got = append(got, err.Error())
+				continue
+			}
+			got = append(got, form.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("split at %d: got %q, want %q", split, got, want)
+		}
+	}
+}
+
+// BenchmarkStreamReaderLargeForm reads a single form of about 1MB, which
+// takes a few hundred reads to arrive.
+func BenchmarkStreamReaderLargeForm(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("(count [")
+	for i := 0; i < 150000; i++ {
+		sb.WriteString(strconv.Itoa(i))
+		sb.WriteByte(' ')
+	}
+	sb.WriteString("])")
+	src := sb.String()
+
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewStreamReader("bench", strings.NewReader(src))
+		if _, err := r.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
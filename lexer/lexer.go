@@ -1,7 +1,9 @@
 package lexer
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -10,10 +12,14 @@ import (
 
 type Pos int
 
+// Item is a token. Pos is its byte offset in the input, Line and Col its
+// line and column, both starting at 1. Col counts bytes, like Pos.
 type Item struct {
 	Type  ItemType
 	Pos   Pos
 	Value string
+	Line  int
+	Col   int
 }
 
 type ItemType int
@@ -26,12 +32,19 @@ const (
 	ItemRightParen
 	ItemLeftVect
 	ItemRightVect
+	ItemLeftBrace
+	ItemRightBrace
+	ItemLeftSet
 
 	ItemIdent
+	ItemKeyword
 	ItemBool
 	ItemString
+	ItemRawString
+	ItemChar
 	ItemFloat
 	ItemInt
+	ItemRational
 	ItemComplex
 
 	ItemQuote
@@ -53,17 +66,31 @@ func (i ItemType) String() string {
 		return "LeftVect"
 	case ItemRightVect:
 		return "RightVect"
+	case ItemLeftBrace:
+		return "LeftBrace"
+	case ItemRightBrace:
+		return "RightBrace"
+	case ItemLeftSet:
+		return "LeftSet"
 
 	case ItemIdent:
 		return "Ident"
+	case ItemKeyword:
+		return "Keyword"
 	case ItemString:
 		return "String"
+	case ItemRawString:
+		return "RawString"
+	case ItemChar:
+		return "Char"
 	case ItemBool:
 		return "Bool"
 	case ItemFloat:
 		return "Float"
 	case ItemInt:
 		return "Int"
+	case ItemRational:
+		return "Rational"
 	case ItemComplex:
 		return "Complex"
 
@@ -92,10 +119,17 @@ type Lexer struct {
 	start   Pos
 	width   Pos
 	lastPos Pos
-	items   chan Item
-
-	parenDepth int
-	vectDepth  int
+	items   chan Item // nil when the lexer is driven by Next
+	queue   []Item    // items emitted but not yet returned by Next
+	ends    []Pos     // the offset just past the text of each queued item
+	head    int
+	end     Pos   // just past the text of the last item returned by Next
+	lines   []Pos // offset of the first byte of every line
+
+	parenDepth   int
+	vectDepth    int
+	braceDepth   int
+	unterminated bool // the input ended inside a string
 }
 
 // next returns the next rune in the input.
@@ -124,10 +158,33 @@ func (l *Lexer) backup() {
 
 // emit passes an Item back to the client.
 func (l *Lexer) emit(t ItemType) {
-	l.items <- Item{t, l.start, l.input[l.start:l.pos]}
+	l.send(l.item(t, l.input[l.start:l.pos]))
 	l.start = l.pos
 }
 
+// send hands item to the goroutine reading l.items, or queues it for Next.
+func (l *Lexer) send(item Item) {
+	if l.items != nil {
+		l.items <- item
+		return
+	}
+	l.queue = append(l.queue, item)
+	l.ends = append(l.ends, l.pos)
+}
+
+// item returns an Item starting at l.start.
+func (l *Lexer) item(t ItemType, value string) Item {
+	line, col := l.LineCol(l.start)
+	return Item{Type: t, Pos: l.start, Value: value, Line: line, Col: col}
+}
+
+// LineCol returns the line and column of the byte offset pos, both starting
+// at 1.
+func (l *Lexer) LineCol(pos Pos) (line, col int) {
+	line = sort.Search(len(l.lines), func(i int) bool { return l.lines[i] > pos })
+	return line, int(pos-l.lines[line-1]) + 1
+}
+
 func (l *Lexer) ignore() {
 	l.start = l.pos
 }
@@ -148,48 +205,172 @@ func (l *Lexer) acceptRun(valid string) {
 	l.backup()
 }
 
+// errorf emits an error item for the text scanned so far, skips it and
+// carries on, so a single pass reports every error in the input. The item
+// holds just the message: a client that lexes its input in pieces positions
+// items itself, for the others Position gives the usual name:line:col
+// prefix.
 func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- Item{ItemError, l.start, fmt.Sprintf(format, args...)}
-	return nil
+	l.send(l.item(ItemError, fmt.Sprintf(format, args...)))
+	l.ignore()
+	return lexWhitespace
 }
 
+// NextItem returns the next item from a Lexer started by Lex.
 func (l *Lexer) NextItem() Item {
 	item := <-l.items
 	l.lastPos = item.Pos
 	return item
 }
 
-func Lex(name, input string) *Lexer {
+// Next returns the next item from a Lexer created by New, running the state
+// machine until it emits one. Once the input is exhausted it keeps returning
+// ItemEOF.
+func (l *Lexer) Next() Item {
+	for l.head == len(l.queue) {
+		if l.state == nil {
+			return l.item(ItemEOF, "")
+		}
+		// reuse the queue, it holds at most a few items
+		l.queue, l.ends, l.head = l.queue[:0], l.ends[:0], 0
+		l.state = l.state(l)
+	}
+	item := l.queue[l.head]
+	l.end = l.ends[l.head]
+	l.head++
+	l.lastPos = item.Pos
+	return item
+}
+
+// New returns a Lexer for input that runs synchronously, items are read with
+// Next.
+func New(name, input string) *Lexer {
 	l := &Lexer{
 		name:  name,
 		input: input,
-		items: make(chan Item),
+		state: lexWhitespace,
+		lines: []Pos{0},
+	}
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\n' {
+			l.lines = append(l.lines, Pos(i+1))
+		}
 	}
+	return l
+}
+
+// Lex returns a Lexer for input that runs in its own goroutine, items are
+// read with NextItem. The goroutine exits once the input is drained.
+func Lex(name, input string) *Lexer {
+	l := New(name, input)
+	l.items = make(chan Item)
 	go l.run()
 	return l
 }
 
+// Name returns the name of the input, as given to New or Lex.
+func (l *Lexer) Name() string {
+	return l.name
+}
+
+// Position returns where item is in the input as name:line:col, or line:col
+// when the input has no name.
+func (l *Lexer) Position(item Item) string {
+	pos := fmt.Sprintf("%d:%d", item.Line, item.Col)
+	if l.name != "" {
+		pos = l.name + ":" + pos
+	}
+	return pos
+}
+
+// Tokenize lexes src in full. The items are returned without the final
+// ItemEOF and without error items, those are reported together in err, one
+// message per line prefixed with its Position.
+func Tokenize(name, src string) ([]Item, error) {
+	l := New(name, src)
+	var items []Item
+	var errs []string
+	for {
+		item := l.Next()
+		switch item.Type {
+		case ItemEOF:
+			if len(errs) > 0 {
+				return items, errors.New(strings.Join(errs, "\n"))
+			}
+			return items, nil
+		case ItemError:
+			errs = append(errs, l.Position(item)+": "+item.Value)
+		default:
+			items = append(items, item)
+		}
+	}
+}
+
 func (l *Lexer) run() {
-	for l.state = lexWhitespace; l.state != nil; {
+	for l.state != nil {
 		l.state = l.state(l)
 	}
 	close(l.items)
 }
 
+// Depth returns the number of parens, brackets and braces left open. It is
+// only meaningful once NextItem or Next has returned ItemEOF.
+func (l *Lexer) Depth() int {
+	return l.parenDepth + l.vectDepth + l.braceDepth
+}
+
+// Offset returns the offset just past the text of the last item returned by
+// Next, including the text skipped by an error item.
+func (l *Lexer) Offset() Pos {
+	return l.end
+}
+
+// Incomplete reports whether the input ended inside a form or a string, so
+// that more input could complete it. Like Depth it is only meaningful once
+// ItemEOF has been returned.
+func (l *Lexer) Incomplete() bool {
+	return l.Depth() > 0 || l.unterminated
+}
+
 func lexLeftVect(l *Lexer) stateFn {
+	l.vectDepth++
 	l.emit(ItemLeftVect)
 
 	return lexWhitespace
 }
 
 func lexRightVect(l *Lexer) stateFn {
+	l.vectDepth--
 	l.emit(ItemRightVect)
 
 	return lexWhitespace
 }
 
+// lexLeftBrace lexes { opening a map and #{ opening a set
+func lexLeftBrace(l *Lexer) stateFn {
+	if l.input[l.start] == '#' && !l.accept("{") {
+		return l.errorf("# must be followed by {")
+	}
+	l.braceDepth++
+	if l.input[l.start] == '#' {
+		l.emit(ItemLeftSet)
+	} else {
+		l.emit(ItemLeftBrace)
+	}
+
+	return lexWhitespace
+}
+
+func lexRightBrace(l *Lexer) stateFn {
+	l.braceDepth--
+	l.emit(ItemRightBrace)
+
+	return lexWhitespace
+}
+
 // lexes an open parenthesis
 func lexLeftParen(l *Lexer) stateFn {
+	l.parenDepth++
 	l.emit(ItemLeftParen)
 
 	return lexWhitespace
@@ -214,25 +395,70 @@ func lexWhitespace(l *Lexer) stateFn {
 		return lexLeftVect
 	case r == ']':
 		return lexRightVect
+	case r == '#' && l.peek() == '#':
+		return lexSpecialFloat
+	case r == '{' || r == '#':
+		return lexLeftBrace
+	case r == '}':
+		return lexRightBrace
 	case r == '"':
 		return lexString
-	case (r == '+' && ('0' <= l.peek() && l.peek() <= '9')) || (r == '+' && ('0' <= l.peek() && l.peek() <= '9')) || ('0' <= r && r <= '9'):
+	case r == '\\':
+		return lexChar
+	case r == '\'' || r == '`' || r == '~':
+		return lexQuote
+	case startsNumber(l.input[l.start:]):
+		// a sign only starts a number when a digit follows, - and -foo are
+		// identifiers
 		return lexNumber
 	case r == ';':
 		return lexComment
-	case isAlphaNumeric(r):
+	case r == ':':
+		return lexKeyword
+	case isAlphaNumeric(r) || r == '.':
 		return lexIdentifier
 	default:
-		panic(fmt.Sprintf("don't know what to do with: %q", r))
+		return l.errorf("unexpected character %q", r)
 	}
 }
 
+// lexQuote lexes the reader macros ', `, ~ and ~@
+func lexQuote(l *Lexer) stateFn {
+	switch l.input[l.start] {
+	case '\'':
+		l.emit(ItemQuote)
+	case '`':
+		l.emit(ItemQuasiQuote)
+	case '~':
+		if l.accept("@") {
+			l.emit(ItemUnquoteSplice)
+		} else {
+			l.emit(ItemUnquote)
+		}
+	}
+	return lexWhitespace
+}
+
+// lexString lexes a quoted string, escapes are left for the reader to
+// decode. """ starts a raw string that runs up to the next """.
 func lexString(l *Lexer) stateFn {
+	if strings.HasPrefix(l.input[l.pos:], `""`) {
+		end := strings.Index(l.input[l.pos+2:], `"""`)
+		if end < 0 {
+			l.pos = Pos(len(l.input))
+			l.unterminated = true
+			return l.errorf("unterminated raw string")
+		}
+		l.pos += Pos(end) + 5
+		l.emit(ItemRawString)
+		return lexWhitespace
+	}
 	for r := l.next(); r != '"'; r = l.next() {
 		if r == '\\' {
 			r = l.next()
 		}
 		if r == EOF {
+			l.unterminated = true
 			return l.errorf("unterminated quoted string")
 		}
 	}
@@ -240,6 +466,22 @@ func lexString(l *Lexer) stateFn {
 	return lexWhitespace
 }
 
+// lexChar lexes a character literal: \a, \( or a name like \newline and
+// \u00e9.
+func lexChar(l *Lexer) stateFn {
+	r := l.next()
+	if r == EOF || isSpace(r) || isEndOfLine(r) {
+		return l.errorf("character name missing after \\")
+	}
+	if unicode.IsLetter(r) {
+		for r = l.next(); unicode.IsLetter(r) || unicode.IsDigit(r); r = l.next() {
+		}
+		l.backup()
+	}
+	l.emit(ItemChar)
+	return lexWhitespace
+}
+
 func lexIdentifier(l *Lexer) stateFn {
 	// TODO(robbiev): modified to accept dots as a quick hack
 	for r := l.next(); isAlphaNumeric(r) || r == '.'; r = l.next() {
@@ -256,13 +498,28 @@ func lexIdentifier(l *Lexer) stateFn {
 		}
 	}
 	l.backup()
+	// a trailing # asks for an auto-gensym inside quasiquote templates
+	l.accept("#")
 
 	l.emit(ItemIdent)
 	return lexWhitespace
 }
 
+// lexKeyword lexes :name
+func lexKeyword(l *Lexer) stateFn {
+	for r := l.next(); isAlphaNumeric(r) || r == '.'; r = l.next() {
+	}
+	l.backup()
+	if l.pos-l.start == 1 {
+		return l.errorf("keyword name missing after :")
+	}
+	l.emit(ItemKeyword)
+	return lexWhitespace
+}
+
 // lex a close parenthesis
 func lexRightParen(l *Lexer) stateFn {
+	l.parenDepth--
 	l.emit(ItemRightParen)
 
 	return lexWhitespace
@@ -271,12 +528,18 @@ func lexRightParen(l *Lexer) stateFn {
 // lex a comment, comment delimiter is known to be already read
 func lexComment(l *Lexer) stateFn {
 	i := strings.Index(l.input[l.pos:], "\n")
+	if i < 0 {
+		// the comment ends the input
+		i = len(l.input) - int(l.pos)
+	}
 	l.pos += Pos(i)
 	l.ignore()
 	return lexWhitespace
 }
 
 func lexNumber(l *Lexer) stateFn {
+	// rescan the first rune, scanNumber needs to see a leading sign or 0x
+	l.pos = l.start
 	if !l.scanNumber() {
 		return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
 	}
@@ -286,13 +549,27 @@ func lexNumber(l *Lexer) stateFn {
 	// 	return lexIdentifier
 	// }
 
-	if sign := l.peek(); sign == '+' || sign == '-' {
+	if l.peek() == '/' {
+		// Rational: 1/3. An integer over an unsigned one, both decimal.
+		l.next()
+		if !isDecimal(strings.TrimLeft(l.input[l.start:l.pos-1], "+-")) || !isDigit(l.peek()) {
+			return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
+		}
+		l.acceptRun("0123456789_")
+		if isAlphaNumeric(l.peek()) {
+			l.next()
+			return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
+		}
+		l.emit(ItemRational)
+	} else if sign := l.peek(); sign == '+' || sign == '-' {
 		// Complex: 1+2i. No spaces, must end in 'i'.
 		if !l.scanNumber() || l.input[l.pos-1] != 'i' {
 			return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
 		}
 		l.emit(ItemComplex)
-	} else if strings.ContainsRune(l.input[l.start:l.pos], '.') {
+	} else if l.input[l.pos-1] == 'i' {
+		l.emit(ItemComplex)
+	} else if isFloat(l.input[l.start:l.pos]) {
 		l.emit(ItemFloat)
 	} else {
 		l.emit(ItemInt)
@@ -301,32 +578,82 @@ func lexNumber(l *Lexer) stateFn {
 	return lexWhitespace
 }
 
+// scanNumber scans a number in Go syntax: an optional sign, a 0x, 0b or 0o
+// prefix and digits that may be separated by underscores. Decimal and hex
+// numbers may have a fraction and an exponent, e and p respectively.
 func (l *Lexer) scanNumber() bool {
 	// Optional leading sign.
 	l.accept("+-")
-	// Is it hex?
-	digits := "0123456789"
-	if l.accept("0") && l.accept("xX") {
-		digits = "0123456789abcdefABCDEF"
+	digits := "0123456789_"
+	exponent := "eE"
+	if l.accept("0") {
+		switch {
+		case l.accept("xX"):
+			digits = "0123456789abcdefABCDEF_"
+			exponent = "pP"
+		case l.accept("bB"):
+			digits = "01_"
+			exponent = ""
+		case l.accept("oO"):
+			digits = "01234567_"
+			exponent = ""
+		}
 	}
 	l.acceptRun(digits)
-	if l.accept(".") {
-		l.acceptRun(digits)
-	}
-	if l.accept("eE") {
-		l.accept("+-")
-		l.acceptRun("0123456789")
+	if exponent != "" {
+		if l.accept(".") {
+			l.acceptRun(digits)
+		}
+		if l.accept(exponent) {
+			l.accept("+-")
+			l.acceptRun("0123456789_")
+		}
 	}
 	// Is it imaginary?
 	l.accept("i")
-	// Next thing mustn't be alphanumeric.
-	if r := l.peek(); isAlphaNumeric(r) {
+	// Next thing mustn't be alphanumeric, a sign may start an imaginary part
+	// and a slash a denominator.
+	if r := l.peek(); isAlphaNumeric(r) && r != '+' && r != '-' && r != '/' {
 		l.next()
 		return false
 	}
 	return true
 }
 
+// lexSpecialFloat lexes ##Inf, ##-Inf and ##NaN, the floats without a
+// literal of their own.
+func lexSpecialFloat(l *Lexer) stateFn {
+	l.next() // the second #
+	for r := l.next(); isAlphaNumeric(r); r = l.next() {
+	}
+	l.backup()
+	switch l.input[l.start+2 : l.pos] {
+	case "Inf", "-Inf", "NaN":
+		l.emit(ItemFloat)
+		return lexWhitespace
+	}
+	return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
+}
+
+// isDecimal reports whether number is made of decimal digits and
+// underscores only.
+func isDecimal(number string) bool {
+	for _, r := range number {
+		if !isDigit(r) && r != '_' {
+			return false
+		}
+	}
+	return number != ""
+}
+
+// isFloat reports whether a scanned number has a fraction or an exponent.
+func isFloat(number string) bool {
+	if strings.ContainsAny(number, "xX") {
+		return strings.ContainsAny(number, ".pP")
+	}
+	return strings.ContainsAny(number, ".eE")
+}
+
 // isSpace reports whether r is a space character.
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
@@ -337,9 +664,26 @@ func isEndOfLine(r rune) bool {
 	return r == '\r' || r == '\n'
 }
 
+// startsNumber reports whether s starts with a number: a digit after an
+// optional sign and decimal point, as in 1, -1, .5 and +.5.
+func startsNumber(s string) bool {
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	if s != "" && s[0] == '.' {
+		s = s[1:]
+	}
+	return s != "" && isDigit(rune(s[0]))
+}
+
+// isDigit reports whether r is a decimal digit.
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
 // isAlphaNumeric reports whether r is a valid rune for an identifier.
 func isAlphaNumeric(r rune) bool {
-	return r == '>' || r == '<' || r == '=' || r == '-' || r == '+' || r == '*' || r == '&' || r == '_' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	return r == '>' || r == '<' || r == '=' || r == '-' || r == '!' || r == '?' || r == '+' || r == '*' || r == '&' || r == '_' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
 func debug(msg string) {
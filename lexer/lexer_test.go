@@ -0,0 +1,169 @@
+package lexer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var benchSrc = strings.Repeat(`;; fib
+(defn fib (n)
+  (if (< n 2)
+    n
+    (+ (fib (- n 1)) (fib (- n 2)))))
+(def person {:name "Ada" :langs #{"go" "lisp"} :born 1815})
+(println (fib 20) [1 2.5 -3 0x1F 1_000] \a "tab\there")
+`, 200)
+
+var lexTests = []struct {
+	name  string
+	input string
+	want  []Item
+}{
+	{"empty", "", []Item{
+		{ItemEOF, 0, "", 1, 1},
+	}},
+	{"list", "(+ 1 -2.5)", []Item{
+		{ItemLeftParen, 0, "(", 1, 1},
+		{ItemIdent, 1, "+", 1, 2},
+		{ItemInt, 3, "1", 1, 4},
+		{ItemFloat, 5, "-2.5", 1, 6},
+		{ItemRightParen, 9, ")", 1, 10},
+		{ItemEOF, 10, "", 1, 11},
+	}},
+	{"lines", "; comment\n[:a \"x\"]\n  #{\\b}", []Item{
+		{ItemLeftVect, 10, "[", 2, 1},
+		{ItemKeyword, 11, ":a", 2, 2},
+		{ItemString, 14, `"x"`, 2, 5},
+		{ItemRightVect, 17, "]", 2, 8},
+		{ItemLeftSet, 21, "#{", 3, 3},
+		{ItemChar, 23, `\b`, 3, 5},
+		{ItemRightBrace, 25, "}", 3, 7},
+		{ItemEOF, 26, "", 3, 8},
+	}},
+	{"errors", "@ 1/\n'x", []Item{
+		{ItemError, 0, "unexpected character '@'", 1, 1},
+		{ItemError, 2, `bad number syntax: "1/"`, 1, 3},
+		{ItemQuote, 5, "'", 2, 1},
+		{ItemIdent, 6, "x", 2, 2},
+		{ItemEOF, 7, "", 2, 3},
+	}},
+	{"comment at the end", "1 ; no newline", []Item{
+		{ItemInt, 0, "1", 1, 1},
+		{ItemEOF, 14, "", 1, 15},
+	}},
+}
+
+func TestNextMatchesLex(t *testing.T) {
+	for _, test := range lexTests {
+		var next, lex []Item
+		l := New(test.name, test.input)
+		for {
+			item := l.Next()
+			next = append(next, item)
+			if item.Type == ItemEOF {
+				break
+			}
+		}
+		l = Lex(test.name, test.input)
+		for {
+			item := l.NextItem()
+			lex = append(lex, item)
+			if item.Type == ItemEOF {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(next, test.want) {
+			t.Errorf("%s: Next gave\n\t%v\nwant\n\t%v", test.name, next, test.want)
+		}
+		if !reflect.DeepEqual(lex, next) {
+			t.Errorf("%s: Lex gave\n\t%v\nNext gave\n\t%v", test.name, lex, next)
+		}
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	items, err := Tokenize("f.tp", "(a @)\n\"open")
+	want := "f.tp:1:4: unexpected character '@'\nf.tp:2:1: unterminated quoted string"
+	if err == nil || err.Error() != want {
+		t.Errorf("Tokenize error = %v, want %q", err, want)
+	}
+	if len(items) != 3 {
+		t.Errorf("Tokenize gave %v, want the 3 items without errors", items)
+	}
+
+	if _, err := Tokenize("", "@"); err == nil || err.Error() != "1:1: unexpected character '@'" {
+		t.Errorf("Tokenize without a name: error = %v", err)
+	}
+	if _, err := Tokenize("f.tp", "(a [b])"); err != nil {
+		t.Errorf("Tokenize: unexpected error %v", err)
+	}
+}
+
+func TestPosition(t *testing.T) {
+	l := New("f.tp", "a\n  @")
+	l.Next()
+	item := l.Next()
+	if l.Name() != "f.tp" || item.Type != ItemError || l.Position(item) != "f.tp:2:3" {
+		t.Errorf("Name() = %q, Position(%v) = %q, want f.tp and f.tp:2:3", l.Name(), item, l.Position(item))
+	}
+	if got := New("", "").Position(item); got != "2:3" {
+		t.Errorf("Position without a name = %q, want 2:3", got)
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		input      string
+		depth      int
+		incomplete bool
+	}{
+		{"(a b)", 0, false},
+		{"(a [b", 2, true},
+		{"{:a #{", 2, true},
+		{"(a)) ", -1, false},
+		{`"open`, 0, true},
+		{`(f """raw`, 1, true},
+		{`"closed" ; "comment`, 0, false},
+	}
+	for _, test := range tests {
+		l := New("", test.input)
+		for l.Next().Type != ItemEOF {
+		}
+		if l.Depth() != test.depth || l.Incomplete() != test.incomplete {
+			t.Errorf("%q: Depth() = %d, Incomplete() = %v, want %d, %v",
+				test.input, l.Depth(), l.Incomplete(), test.depth, test.incomplete)
+		}
+	}
+}
+
+func BenchmarkLex(b *testing.B) {
+	b.SetBytes(int64(len(benchSrc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l := Lex("bench", benchSrc)
+		for l.NextItem().Type != ItemEOF {
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	b.SetBytes(int64(len(benchSrc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l := New("bench", benchSrc)
+		for l.Next().Type != ItemEOF {
+		}
+	}
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	b.SetBytes(int64(len(benchSrc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Tokenize("bench", benchSrc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
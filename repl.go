@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterh/liner"
+	"github.com/robbiev/tipi/interp"
+	"github.com/robbiev/tipi/lexer"
+)
+
+const (
+	prompt         = "tipi> "
+	continuePrompt = "...   "
+)
+
+// repl reads forms from the terminal one entry at a time. An entry is only
+// evaluated once all of its parens and brackets are closed, so a form can span
+// several lines. Definitions and macros carry over between entries.
+func repl(in *interp.Interpreter) {
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+
+	historyPath := filepath.Join(os.Getenv("HOME"), ".tipi_history")
+	if f, err := os.Open(historyPath); err == nil {
+		line.ReadHistory(f)
+		f.Close()
+	}
+	defer func() {
+		if f, err := os.Create(historyPath); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	var src string
+	for {
+		p := prompt
+		if src != "" {
+			p = continuePrompt
+		}
+		input, err := line.Prompt(p)
+		if err == liner.ErrPromptAborted {
+			src = ""
+			continue
+		}
+		if err == io.EOF {
+			fmt.Println()
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		src += input + "\n"
+		if incomplete(src) {
+			continue
+		}
+
+		if entry := strings.Join(strings.Fields(src), " "); entry != "" {
+			line.AppendHistory(entry)
+		}
+		replEval(in, src)
+		src = ""
+	}
+}
+
+// incomplete reports whether src has forms or strings left open.
+func incomplete(src string) bool {
+	l := lexer.New("<repl>", src)
+	for l.Next().Type != lexer.ItemEOF {
+	}
+	return l.Incomplete()
+}
+
+// replEval evaluates every form in src, printing each result. Errors are
+// reported rather than ending the session.
+func replEval(in *interp.Interpreter, src string) {
+	r := interp.NewReader("<repl>", src)
+	for {
+		program, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if err == nil {
+			program, err = in.EvalForm(context.Background(), program)
+		}
+		if err != nil {
+			printError(os.Stdout, err)
+			return
+		}
+
+		fmt.Println(program)
+	}
+}